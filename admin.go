@@ -0,0 +1,308 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RepositoryStatus is a status of a managed repository.
+type RepositoryStatus struct {
+	UpstreamURL         string             `json:"upstream_url"`
+	LocalDiskPath       string             `json:"local_disk_path"`
+	LastUpdateTime      time.Time          `json:"last_update_time"`
+	LastMaintenanceTime time.Time          `json:"last_maintenance_time"`
+	LastAccessTime      time.Time          `json:"last_access_time"`
+	DiskUsageBytes      int64              `json:"disk_usage_bytes"`
+	RefCount            int                `json:"ref_count"`
+	RunningOperations   []*OperationStatus `json:"running_operations"`
+	LastError           *OperationError    `json:"last_error,omitempty"`
+}
+
+// OperationStatus is a long running operation running on a managed
+// repository.
+type OperationStatus struct {
+	Name      string    `json:"name"`
+	StartTime time.Time `json:"start_time"`
+}
+
+// OperationError is an error of a long running operation.
+type OperationError struct {
+	Operation string    `json:"operation"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// AdminHTTPHandler returns an HTTP handler of the admin API. The requests are
+// authorized with ServerConfig.AdminRequestAuthorizer. If it's nil, all
+// requests are rejected.
+//
+// The API has the following endpoints. URL is a repository URL that is
+// canonicalized in the same way as the Git requests.
+//
+//	GET  /repositories                       List the managed repositories.
+//	GET  /repositories/status?url=URL        Show the repository status.
+//	POST /repositories/refresh?url=URL       Fetch the repository from the upstream.
+//	POST /repositories/evict?url=URL         Remove the repository from the cache.
+//	POST /repositories/maintenance?url=URL   Run the repository maintenance.
+//	GET  /repositories/bundle?url=URL        Download a bundle of the repository.
+func AdminHTTPHandler(config *ServerConfig) http.Handler {
+	s := &adminServer{config: config, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/repositories", s.handleList)
+	s.mux.HandleFunc("/repositories/status", s.handleStatus)
+	s.mux.HandleFunc("/repositories/refresh", s.handleRefresh)
+	s.mux.HandleFunc("/repositories/evict", s.handleEvict)
+	s.mux.HandleFunc("/repositories/maintenance", s.handleMaintenance)
+	s.mux.HandleFunc("/repositories/bundle", s.handleBundle)
+	return s
+}
+
+type adminServer struct {
+	config *ServerConfig
+	mux    *http.ServeMux
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.AdminRequestAuthorizer == nil {
+		writeAdminError(w, status.Error(codes.PermissionDenied, "admin API is not enabled"))
+		return
+	}
+	if err := s.config.AdminRequestAuthorizer(r); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *adminServer) handleList(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	ret := []*RepositoryStatus{}
+	managedRepos.Range(func(key, value interface{}) bool {
+		ret = append(ret, value.(*managedRepository).status())
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].LocalDiskPath < ret[j].LocalDiskPath })
+	writeJSON(w, ret)
+}
+
+func (s *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	repo, err := s.lookupRepository(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	writeJSON(w, repo.status())
+}
+
+func (s *adminServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") {
+		return
+	}
+	u, err := repositoryURLParam(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	// Unlike the other actions, a repository that is not cached yet is
+	// created so that the cache can be primed.
+	repo, err := openManagedRepository(s.config, u)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := repo.waitForRestore(r.Context()); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	f := repo.requestFetchUpstream()
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return
+	}
+	if f.err != nil {
+		writeAdminError(w, status.Errorf(codes.Unavailable, "cannot fetch from the upstream: %v", f.err))
+		return
+	}
+	writeJSON(w, repo.status())
+}
+
+func (s *adminServer) handleEvict(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") {
+		return
+	}
+	repo, err := s.lookupRepository(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := repo.evict(); err != nil {
+		writeAdminError(w, status.Errorf(codes.Internal, "cannot evict the repository: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *adminServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "POST") {
+		return
+	}
+	repo, err := s.lookupRepository(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	if err := repo.RunMaintenance(); err != nil {
+		writeAdminError(w, status.Errorf(codes.Internal, "maintenance failed: %v", err))
+		return
+	}
+	writeJSON(w, repo.status())
+}
+
+func (s *adminServer) handleBundle(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r, "GET") {
+		return
+	}
+	repo, err := s.lookupRepository(r)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := repo.WriteBundle(w); err != nil {
+		// The response might be partially written. Truncated bundles
+		// are detected by the client.
+		log.Printf("Cannot write a bundle of %s: %v", repo.localDiskPath, err)
+	}
+}
+
+// lookupRepository returns the cached repository of the url parameter. This
+// doesn't create a new repository.
+func (s *adminServer) lookupRepository(r *http.Request) (*managedRepository, error) {
+	u, err := repositoryURLParam(r)
+	if err != nil {
+		return nil, err
+	}
+	u, err = s.config.URLCanonializer(u)
+	if err != nil {
+		return nil, err
+	}
+	localDiskPath := filepath.Join(s.config.LocalDiskCacheRoot, u.Host, u.Path)
+	if !isBareRepository(localDiskPath) {
+		return nil, status.Errorf(codes.NotFound, "%s is not cached", u)
+	}
+	return loadManagedRepo(s.config, localDiskPath)
+}
+
+func repositoryURLParam(r *http.Request) (*url.URL, error) {
+	s := r.URL.Query().Get("url")
+	if s == "" {
+		return nil, status.Error(codes.InvalidArgument, "url parameter is required")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot parse the url parameter: %v", err)
+	}
+	return u, nil
+}
+
+func (r *managedRepository) status() *RepositoryStatus {
+	st := &RepositoryStatus{
+		UpstreamURL:       r.upstreamURL.String(),
+		LocalDiskPath:     r.localDiskPath,
+		DiskUsageBytes:    diskUsage(r.localDiskPath),
+		RunningOperations: []*OperationStatus{},
+	}
+	if t := atomic.LoadInt64(&r.lastAccess); t != 0 {
+		st.LastAccessTime = time.Unix(0, t)
+	}
+
+	st.LastUpdateTime = r.LastUpdateTime()
+	if t := atomic.LoadInt64(&r.lastMaintenance); t != 0 {
+		st.LastMaintenanceTime = time.Unix(0, t)
+	}
+
+	r.opsMu.Lock()
+	for op := range r.runningOps {
+		st.RunningOperations = append(st.RunningOperations, &OperationStatus{Name: op.name, StartTime: op.startTime})
+	}
+	st.LastError = r.lastError
+	r.opsMu.Unlock()
+	sort.Slice(st.RunningOperations, func(i, j int) bool {
+		return st.RunningOperations[i].StartTime.Before(st.RunningOperations[j].StartTime)
+	})
+
+	if g, err := git.PlainOpen(r.localDiskPath); err == nil {
+		if refs, err := g.References(); err == nil {
+			refs.ForEach(func(ref *plumbing.Reference) error {
+				if !strings.HasPrefix(ref.Name().String(), fetchStagingRefPrefix) {
+					st.RefCount++
+				}
+				return nil
+			})
+		}
+	}
+	return st
+}
+
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Cannot write an admin API response: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	code := codes.Internal
+	message := err.Error()
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+		message = st.Message()
+	}
+	if code == codes.Unauthenticated {
+		w.Header().Add("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, message, runtime.HTTPStatusFromCode(code))
+}
@@ -0,0 +1,563 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup backs up the managed repositories as Git bundles to an
+// ObjectStore and restores them.
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/goblet"
+)
+
+const (
+	gobletRepoManifestDir = "goblet-repository-manifests"
+
+	manifestCleanUpDuration = 24 * time.Hour
+
+	backupFrequency = time.Hour
+
+	// fullBundleInterval is the interval of creating a full bundle that
+	// starts a new bundle chain.
+	fullBundleInterval = 24 * time.Hour
+)
+
+var errNoBackup = errors.New("no backup found")
+
+// RunBackupProcess restores the repositories from the backup in the
+// background, and then saves the backup periodically.
+func RunBackupProcess(config *goblet.ServerConfig, store ObjectStore, manifestName string, logger *log.Logger) {
+	rw := &ReaderWriter{
+		Store:        store,
+		ManifestName: manifestName,
+		Config:       config,
+		Logger:       logger,
+	}
+	rw.Run()
+}
+
+// ReaderWriter saves and restores the backup of the managed repositories.
+//
+// The backup consists of the bundles of the repositories and the manifests.
+// A manifest is a list of the repository URLs that are backed up. The
+// manifests are created under "goblet-repository-manifests/MANIFEST_NAME/",
+// and the bundles are created under "HOST/PATH/". The bundles of a repository
+// form a bundle chain, a full bundle followed by incremental bundles, which is
+// described in "HOST/PATH/chain.json" with the checksums of the bundles.
+type ReaderWriter struct {
+	Store        ObjectStore
+	ManifestName string
+	Config       *goblet.ServerConfig
+	Logger       *log.Logger
+
+	// RestoreConcurrency is the number of the repositories restored in
+	// parallel. Defaults to 1.
+	RestoreConcurrency int
+
+	// LazyRestore makes Run skip the restore at startup. Set RestoreRepository
+	// to ServerConfig.RepositoryRestorer to restore the repositories when
+	// they're requested.
+	LazyRestore bool
+}
+
+// Run restores the repositories from the backup in the background, and then
+// saves the backup periodically. The restores are queued before this returns
+// so that the requests to the repositories wait for them. With LazyRestore,
+// this only saves the backup.
+func (b *ReaderWriter) Run() {
+	var restored <-chan struct{}
+	if !b.LazyRestore {
+		restored = b.StartRecovery()
+	}
+	go func() {
+		if restored != nil {
+			<-restored
+		}
+		timer := time.NewTimer(backupFrequency)
+		for {
+			select {
+			case <-timer.C:
+				b.SaveBackup()
+			}
+			timer.Reset(backupFrequency)
+		}
+	}()
+}
+
+// RecoverFromBackup restores the repositories in the manifests, and waits for
+// them.
+func (b *ReaderWriter) RecoverFromBackup() {
+	<-b.StartRecovery()
+}
+
+// StartRecovery queues the restores of the repositories in the manifests, and
+// runs them in the background with RestoreConcurrency workers. The returned
+// channel is closed when all restores finish.
+func (b *ReaderWriter) StartRecovery() <-chan struct{} {
+	done := make(chan struct{})
+	repos := b.readRepoList()
+	if repos == nil || len(repos) == 0 {
+		b.Logger.Print("No repositories found from backup")
+		close(done)
+		return done
+	}
+
+	queued := []*queuedRestore{}
+	for rawURL, _ := range repos {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			b.Logger.Printf("Cannot parse %s as a URL. Skipping", rawURL)
+			continue
+		}
+
+		m, err := goblet.OpenManagedRepository(b.Config, u)
+		if err != nil {
+			b.Logger.Printf("Cannot open a managed repository for %s. Skipping: %v", rawURL, err)
+			continue
+		}
+		queued = append(queued, &queuedRestore{m, goblet.QueueRestore(m)})
+	}
+
+	concurrency := b.RestoreConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ch := make(chan *queuedRestore)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range ch {
+				b.runRestore(q)
+			}
+		}()
+	}
+	go func() {
+		for _, q := range queued {
+			ch <- q
+		}
+		close(ch)
+		wg.Wait()
+		b.Logger.Printf("Finished restoring %d repositories from backup", len(queued))
+		close(done)
+	}()
+	return done
+}
+
+type queuedRestore struct {
+	m   goblet.ManagedRepository
+	run func(func() error) (bool, error)
+}
+
+func (b *ReaderWriter) runRestore(q *queuedRestore) {
+	u := q.m.UpstreamURL()
+	ran, err := q.run(func() error {
+		return b.recoverRepository(q.m)
+	})
+	if !ran {
+		b.Logger.Printf("Skipping the restore of %s as it's requested before the restore", u.String())
+	} else if err != nil {
+		b.Logger.Printf("Cannot restore %s from backup. Skipping: %v", u.String(), err)
+	}
+}
+
+// RestoreRepository restores the repository from its latest backup. This does
+// nothing if the repository has no backup. This can be used as
+// ServerConfig.RepositoryRestorer.
+func (b *ReaderWriter) RestoreRepository(m goblet.ManagedRepository) error {
+	if err := b.recoverRepository(m); err != nil && err != errNoBackup {
+		return err
+	}
+	return nil
+}
+
+// recoverRepository restores the repository from the bundle chain. If the
+// chain has a broken bundle, the bundles before it are used. If the full bundle
+// of the chain is broken, the previous chain is used.
+func (b *ReaderWriter) recoverRepository(m goblet.ManagedRepository) error {
+	u := m.UpstreamURL()
+	name := path.Join(u.Host, u.Path)
+	candidates, err := b.restoreCandidates(name)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return errNoBackup
+	}
+
+	for _, bundles := range candidates {
+		n, err := b.recoverFromBundles(m, bundles)
+		if n == len(bundles) {
+			return nil
+		}
+		if n > 0 {
+			b.Logger.Printf("Restored %s from %d of %d bundles: %v", u.String(), n, len(bundles), err)
+			return nil
+		}
+		b.Logger.Printf("Cannot restore %s from %s. Trying the previous backup: %v", u.String(), bundles[0].Name, err)
+	}
+	return fmt.Errorf("no valid backup found for %s", name)
+}
+
+// restoreCandidates returns the bundle lists to try in order.
+func (b *ReaderWriter) restoreCandidates(name string) ([][]*chainedBundle, error) {
+	candidates := [][]*chainedBundle{}
+	for _, chainFile := range []string{bundleChainFile, previousBundleChainFile} {
+		chain, err := b.readBundleChainFile(path.Join(name, chainFile))
+		if err != nil {
+			b.Logger.Printf("Cannot read the bundle chain of %s. Skipping: %v", name, err)
+			continue
+		}
+		if chain != nil {
+			candidates = append(candidates, chain.bundles())
+		}
+	}
+	if len(candidates) != 0 {
+		return candidates, nil
+	}
+
+	// The backup made before the bundle chain was introduced. Try the
+	// newer ones first.
+	bundleNames, err := b.listFullBundles(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, bundleName := range bundleNames {
+		candidates = append(candidates, []*chainedBundle{{Name: bundleName}})
+	}
+	return candidates, nil
+}
+
+// recoverFromBundles downloads and applies the bundles in order until one of
+// them fails. It returns the number of the applied bundles.
+func (b *ReaderWriter) recoverFromBundles(m goblet.ManagedRepository, bundles []*chainedBundle) (int, error) {
+	for i, e := range bundles {
+		bundlePath, err := b.downloadBundle(e)
+		if err != nil {
+			return i, err
+		}
+		err = m.RecoverFromBundle(bundlePath)
+		os.Remove(bundlePath)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(bundles), nil
+}
+
+func (b *ReaderWriter) readRepoList() map[string]bool {
+	names, err := b.Store.List(context.Background(), path.Join(gobletRepoManifestDir, b.ManifestName)+"/")
+	if err != nil {
+		b.Logger.Printf("Error while finding the manifests: %v", err)
+		return nil
+	}
+	repos := map[string]bool{}
+	for _, name := range names {
+		b.readManifest(name, repos)
+	}
+	return repos
+}
+
+func (b *ReaderWriter) readManifest(name string, m map[string]bool) {
+	rc, err := b.Store.NewReader(context.Background(), name)
+	if err != nil {
+		b.Logger.Printf("Cannot open a manifest file %s. Skipping: %v", name, err)
+		return
+	}
+	defer rc.Close()
+
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		if s := strings.TrimSpace(sc.Text()); s != "" {
+			m[s] = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		b.Logger.Printf("Error while reading a manifest file %s. Skipping the rest of the file: %v", name, err)
+	}
+}
+
+// downloadBundle downloads the bundle to a temporary file and checks its
+// checksum.
+func (b *ReaderWriter) downloadBundle(e *chainedBundle) (string, error) {
+	rc, err := b.Store.NewReader(context.Background(), e.Name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	fi, err := ioutil.TempFile(b.Config.LocalDiskCacheRoot, "tmp-bundle-")
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(fi, h), rc); err != nil {
+		os.Remove(fi.Name())
+		return "", err
+	}
+	want := e.SHA256
+	if want == "" {
+		// Not in a chain. Use the checksum stored with the bundle.
+		if metadata, err := b.Store.Metadata(context.Background(), e.Name); err == nil {
+			want = metadata[sha256MetadataKey]
+		}
+	}
+	if want != "" && hex.EncodeToString(h.Sum(nil)) != want {
+		os.Remove(fi.Name())
+		return "", fmt.Errorf("checksum mismatch of %s", e.Name)
+	}
+	return fi.Name(), nil
+}
+
+// listFullBundles returns the bundles named with a timestamp, newest first.
+func (b *ReaderWriter) listFullBundles(name string) ([]string, error) {
+	names, err := b.Store.List(context.Background(), name+"/")
+	if err != nil {
+		return nil, fmt.Errorf("error while finding the bundles: %v", err)
+	}
+
+	bundles := []string{}
+	for _, name := range names {
+		// Ignore non-bundles.
+		if _, err := strconv.ParseInt(path.Base(name), 10, 64); err != nil {
+			continue
+		}
+		bundles = append(bundles, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(bundles)))
+	return bundles, nil
+}
+
+// SaveBackup creates the bundles of the managed repositories that are updated
+// since the last backup, and writes a new manifest.
+func (b *ReaderWriter) SaveBackup() {
+	urls := []string{}
+	goblet.ListManagedRepositories(func(m goblet.ManagedRepository) {
+		u := m.UpstreamURL()
+		if err := b.backupManagedRepo(m); err != nil {
+			b.Logger.Printf("cannot make a backup for %s. Skipping: %v", u.String(), err)
+			return
+		}
+
+		urls = append(urls, u.String())
+	})
+
+	now := time.Now()
+	manifestFile := path.Join(gobletRepoManifestDir, b.ManifestName, fmt.Sprintf("%012d", now.Unix()))
+	if err := b.writeManifestFile(manifestFile, urls); err != nil {
+		b.Logger.Printf("cannot create %s: %v", manifestFile, err)
+		return
+	}
+
+	b.garbageCollectOldManifests(now)
+}
+
+// backupManagedRepo adds a bundle to the bundle chain of the repository. A
+// full bundle starts a new chain if the chain doesn't exist or its base is
+// older than fullBundleInterval. Otherwise, an incremental bundle based on the
+// refs of the last backup is added. The replaced chain is kept as the previous
+// chain.
+//
+// The new bundle is verified before it's uploaded, and the uploaded object is
+// checked with the checksum. The old bundles are deleted only after that.
+func (b *ReaderWriter) backupManagedRepo(m goblet.ManagedRepository) error {
+	u := m.UpstreamURL()
+	name := path.Join(u.Host, u.Path)
+	// An error from the store can be temporary. Try again at the next
+	// backup rather than replacing the chains that cannot be read now.
+	canGC := true
+	chain, err := b.readBundleChain(name)
+	if _, ok := err.(*invalidBundleChainError); ok {
+		// Start a new chain. The bundles of the broken one are kept
+		// until the new chain replaces it.
+		b.Logger.Printf("cannot read the bundle chain of %s. Creating a full bundle: %v", u.String(), err)
+		chain = nil
+		canGC = false
+	} else if err != nil {
+		return err
+	}
+	previous, err := b.readBundleChainFile(path.Join(name, previousBundleChainFile))
+	if _, ok := err.(*invalidBundleChainError); ok {
+		b.Logger.Printf("cannot read the previous bundle chain of %s: %v", u.String(), err)
+		previous = nil
+		canGC = false
+	} else if err != nil {
+		return err
+	}
+
+	lastUpdate := m.LastUpdateTime()
+	var base map[string]string
+	rotated := false
+	if chain != nil {
+		last := chain.Bundles[len(chain.Bundles)-1]
+		// The bundle timestmap is seconds precision.
+		if last.UpdateTime.Unix() >= lastUpdate.Unix() {
+			b.Logger.Printf("existing bundle for %s is up-to-date %s", u.String(), last.UpdateTime.Format(time.RFC3339))
+			return nil
+		}
+		if time.Since(chain.Bundles[0].CreateTime) < fullBundleInterval {
+			base = last.Refs
+		} else {
+			previous, chain, rotated = chain, nil, true
+		}
+	}
+
+	tmp, err := ioutil.TempFile(b.Config.LocalDiskCacheRoot, "tmp-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Write the bundle to a local file first so that the repository is not
+	// blocked while uploading.
+	h := sha256.New()
+	refs, err := m.WriteIncrementalBundle(io.MultiWriter(tmp, h), base)
+	if err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if chain == nil && size == 0 {
+		return fmt.Errorf("the repository is empty")
+	}
+
+	entry := &chainedBundle{
+		UpdateTime: lastUpdate,
+		CreateTime: time.Now(),
+		Refs:       refs,
+	}
+	// An incremental bundle is not created if there's no new object, but
+	// the refs are still recorded.
+	if size != 0 {
+		if err := m.VerifyBundle(tmp.Name()); err != nil {
+			return fmt.Errorf("the new bundle is broken: %v", err)
+		}
+		entry.Name = path.Join(name, fmt.Sprintf("%012d", lastUpdate.Unix()))
+		if chain != nil {
+			entry.Name += incrementalBundleSuffix
+		}
+		entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// The checksum is stored with the object as well, so that the
+		// bundle can be checked without the chain.
+		metadata := map[string]string{sha256MetadataKey: entry.SHA256}
+		err := b.Store.Write(context.Background(), entry.Name, metadata, func(w io.Writer) error {
+			_, err := io.Copy(w, tmp)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := b.verifyStoredBundle(entry); err != nil {
+			return err
+		}
+	}
+	if chain == nil {
+		chain = &bundleChain{}
+	}
+	chain.Bundles = append(chain.Bundles, entry)
+	if rotated {
+		if err := b.writeBundleChainFile(path.Join(name, previousBundleChainFile), previous); err != nil {
+			return err
+		}
+	}
+	if err := b.writeBundleChainFile(path.Join(name, bundleChainFile), chain); err != nil {
+		return err
+	}
+	if canGC {
+		b.gcBundles(name, chain, previous)
+	}
+	return nil
+}
+
+// verifyStoredBundle reads the uploaded bundle and checks its checksum.
+func (b *ReaderWriter) verifyStoredBundle(e *chainedBundle) error {
+	metadata, err := b.Store.Metadata(context.Background(), e.Name)
+	if err != nil {
+		return fmt.Errorf("cannot read the metadata of the uploaded bundle %s: %v", e.Name, err)
+	}
+	if metadata[sha256MetadataKey] != e.SHA256 {
+		return fmt.Errorf("checksum mismatch of the uploaded bundle %s metadata", e.Name)
+	}
+
+	rc, err := b.Store.NewReader(context.Background(), e.Name)
+	if err != nil {
+		return fmt.Errorf("cannot read the uploaded bundle %s: %v", e.Name, err)
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return fmt.Errorf("cannot read the uploaded bundle %s: %v", e.Name, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != e.SHA256 {
+		return fmt.Errorf("checksum mismatch of the uploaded bundle %s", e.Name)
+	}
+	return nil
+}
+
+func (b *ReaderWriter) writeManifestFile(manifestFile string, urls []string) error {
+	return b.Store.Write(context.Background(), manifestFile, nil, func(w io.Writer) error {
+		for _, url := range urls {
+			if _, err := io.WriteString(w, url+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *ReaderWriter) garbageCollectOldManifests(now time.Time) {
+	threshold := now.Add(-manifestCleanUpDuration)
+	names, err := b.Store.List(context.Background(), path.Join(gobletRepoManifestDir, b.ManifestName)+"/")
+	if err != nil {
+		b.Logger.Printf("Error while finding the manifests to GC: %v", err)
+		return
+	}
+	for _, name := range names {
+		sec, err := strconv.ParseInt(path.Base(name), 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.Unix(sec, 0)
+		if t.Before(threshold) {
+			b.Store.Delete(context.Background(), name)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+const (
+	bundleChainFile = "chain.json"
+
+	// previousBundleChainFile is the chain replaced by the last full
+	// bundle. This is kept as a fallback of the restore.
+	previousBundleChainFile = "previous-chain.json"
+
+	incrementalBundleSuffix = ".incremental"
+
+	// sha256MetadataKey is the object metadata key of the hex-encoded
+	// SHA-256 checksum of a bundle.
+	sha256MetadataKey = "sha256"
+)
+
+// bundleChain is a full bundle followed by incremental bundles. Each
+// incremental bundle has the objects that are not reachable from the refs of
+// the previous entry. The chain also serves as the metadata of the bundles,
+// such as the checksums.
+type bundleChain struct {
+	Bundles []*chainedBundle `json:"bundles"`
+}
+
+type chainedBundle struct {
+	// Name is the object name of the bundle. This is empty if there was no
+	// new object since the previous entry.
+	Name string `json:"name,omitempty"`
+
+	// SHA256 is the hex-encoded SHA-256 checksum of the bundle.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// UpdateTime is the last update time of the repository that the bundle
+	// is created from.
+	UpdateTime time.Time `json:"update_time"`
+
+	// CreateTime is the time that the bundle is created.
+	CreateTime time.Time `json:"create_time"`
+
+	// Refs is the refs of the repository that the bundle is created from.
+	Refs map[string]string `json:"refs"`
+}
+
+// bundles returns the entries that have a bundle.
+func (c *bundleChain) bundles() []*chainedBundle {
+	ret := []*chainedBundle{}
+	for _, e := range c.Bundles {
+		if e.Name != "" {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// invalidBundleChainError is returned when a chain file exists but cannot be
+// used. Unlike the errors of the object store, this is not temporary.
+type invalidBundleChainError struct {
+	chainName string
+	msg       string
+}
+
+func (e *invalidBundleChainError) Error() string {
+	return fmt.Sprintf("invalid bundle chain %s: %s", e.chainName, e.msg)
+}
+
+// readBundleChain reads the bundle chain of the repository. This returns nil if
+// there's no chain.
+func (b *ReaderWriter) readBundleChain(name string) (*bundleChain, error) {
+	return b.readBundleChainFile(path.Join(name, bundleChainFile))
+}
+
+func (b *ReaderWriter) readBundleChainFile(chainName string) (*bundleChain, error) {
+	names, err := b.Store.List(context.Background(), chainName)
+	if err != nil {
+		return nil, fmt.Errorf("error while finding the bundle chain: %v", err)
+	}
+	found := false
+	for _, n := range names {
+		if n == chainName {
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	rc, err := b.Store.NewReader(context.Background(), chainName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", chainName, err)
+	}
+	chain := &bundleChain{}
+	if err := json.Unmarshal(bs, chain); err != nil {
+		return nil, &invalidBundleChainError{chainName, err.Error()}
+	}
+	if len(chain.Bundles) == 0 || chain.Bundles[0].Name == "" {
+		return nil, &invalidBundleChainError{chainName, "doesn't start with a full bundle"}
+	}
+	return chain, nil
+}
+
+func (b *ReaderWriter) writeBundleChainFile(chainName string, chain *bundleChain) error {
+	return b.Store.Write(context.Background(), chainName, nil, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(chain)
+	})
+}
+
+// gcBundles deletes the bundles of the repository that are not in the chains.
+// This should be called after the bundles in the chains are verified, and only
+// if the chain files have been read successfully or don't exist. Otherwise the
+// bundles of a chain that couldn't be read would be deleted.
+func (b *ReaderWriter) gcBundles(name string, chains ...*bundleChain) {
+	names, err := b.Store.List(context.Background(), name+"/")
+	if err != nil {
+		b.Logger.Printf("Error while finding the bundles to GC: %v", err)
+		return
+	}
+	keep := map[string]bool{
+		path.Join(name, bundleChainFile):         true,
+		path.Join(name, previousBundleChainFile): true,
+	}
+	for _, chain := range chains {
+		if chain == nil {
+			continue
+		}
+		for _, e := range chain.bundles() {
+			keep[e.Name] = true
+		}
+	}
+	for _, n := range names {
+		if !keep[n] {
+			b.Store.Delete(context.Background(), n)
+		}
+	}
+}
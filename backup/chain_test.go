@@ -0,0 +1,361 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+)
+
+// fakeRepository is a goblet.ManagedRepository whose bundle is a string. An
+// incremental bundle has the refs that are not in the base.
+type fakeRepository struct {
+	lastUpdate time.Time
+	refs       map[string]string
+	// recovered is the contents of the bundles passed to
+	// RecoverFromBundle.
+	recovered []string
+}
+
+func (r *fakeRepository) UpstreamURL() *url.URL {
+	return &url.URL{Scheme: "https", Host: "example.com", Path: "/repo"}
+}
+
+func (r *fakeRepository) LastUpdateTime() time.Time {
+	return r.lastUpdate
+}
+
+func (r *fakeRepository) RecoverFromBundle(bundlePaths ...string) error {
+	for _, p := range bundlePaths {
+		bs, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		r.recovered = append(r.recovered, string(bs))
+	}
+	return nil
+}
+
+func (r *fakeRepository) WriteBundle(w io.Writer) error {
+	_, err := r.WriteIncrementalBundle(w, nil)
+	return err
+}
+
+func (r *fakeRepository) WriteIncrementalBundle(w io.Writer, base map[string]string) (map[string]string, error) {
+	refs := map[string]string{}
+	for name, hash := range r.refs {
+		refs[name] = hash
+		if base[name] != hash {
+			fmt.Fprintf(w, "%s %s\n", hash, name)
+		}
+	}
+	return refs, nil
+}
+
+func (r *fakeRepository) VerifyBundle(string) error {
+	return nil
+}
+
+func (r *fakeRepository) RunMaintenance() error {
+	return nil
+}
+
+// update makes the repository updated with the ref.
+func (r *fakeRepository) update(name, hash string) {
+	if r.refs == nil {
+		r.refs = map[string]string{}
+	}
+	r.refs[name] = hash
+	r.lastUpdate = r.lastUpdate.Add(time.Minute)
+}
+
+func newTestReaderWriter(t *testing.T, store ObjectStore) (*ReaderWriter, func()) {
+	dir, err := ioutil.TempDir("", "goblet_backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &ReaderWriter{
+		Store:  store,
+		Config: &goblet.ServerConfig{LocalDiskCacheRoot: dir},
+		Logger: log.New(ioutil.Discard, "", 0),
+	}
+	return b, func() { os.RemoveAll(dir) }
+}
+
+func readChain(t *testing.T, b *ReaderWriter, chainFile string) *bundleChain {
+	t.Helper()
+	chain, err := b.readBundleChainFile(path.Join("example.com/repo", chainFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chain
+}
+
+func bundleNames(chain *bundleChain) []string {
+	names := []string{}
+	if chain != nil {
+		for _, e := range chain.bundles() {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+func listRepoObjects(t *testing.T, store ObjectStore) []string {
+	t.Helper()
+	names, err := store.List(context.Background(), "example.com/repo/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// ageChain makes the chain older than fullBundleInterval.
+func ageChain(t *testing.T, b *ReaderWriter) {
+	t.Helper()
+	chain := readChain(t, b, bundleChainFile)
+	chain.Bundles[0].CreateTime = chain.Bundles[0].CreateTime.Add(-fullBundleInterval - time.Minute)
+	if err := b.writeBundleChainFile("example.com/repo/"+bundleChainFile, chain); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupManagedRepo_Chain(t *testing.T) {
+	store, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	b, cleanupRW := newTestReaderWriter(t, store)
+	defer cleanupRW()
+	m := &fakeRepository{lastUpdate: time.Unix(1000000, 0)}
+	backup := func() {
+		t.Helper()
+		if err := b.backupManagedRepo(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.update("refs/heads/main", "1")
+	backup()
+	full := fmt.Sprintf("example.com/repo/%012d", m.lastUpdate.Unix())
+	if got := bundleNames(readChain(t, b, bundleChainFile)); !reflect.DeepEqual(got, []string{full}) {
+		t.Fatalf("got %v, want only the full bundle %s", got, full)
+	}
+	if metadata, err := store.Metadata(context.Background(), full); err != nil || metadata[sha256MetadataKey] == "" {
+		t.Errorf("got (%v, %v), want the checksum in the metadata", metadata, err)
+	}
+
+	// Nothing is added if the repository hasn't been updated.
+	backup()
+	if got := len(readChain(t, b, bundleChainFile).Bundles); got != 1 {
+		t.Errorf("got %d entries after a backup without updates, want 1", got)
+	}
+
+	// An incremental bundle has only the new refs.
+	m.update("refs/heads/dev", "2")
+	backup()
+	incremental := fmt.Sprintf("example.com/repo/%012d%s", m.lastUpdate.Unix(), incrementalBundleSuffix)
+	chain := readChain(t, b, bundleChainFile)
+	if got := bundleNames(chain); !reflect.DeepEqual(got, []string{full, incremental}) {
+		t.Fatalf("got %v, want %v", got, []string{full, incremental})
+	}
+	if got := readObject(t, store, incremental); got != "2 refs/heads/dev\n" {
+		t.Errorf("got an incremental bundle %q, want only the new ref", got)
+	}
+	if got := chain.Bundles[1].Refs; !reflect.DeepEqual(got, m.refs) {
+		t.Errorf("got refs %v, want %v", got, m.refs)
+	}
+
+	// A new full bundle starts a new chain, and the old one is kept as
+	// the previous chain.
+	ageChain(t, b)
+	m.update("refs/heads/main", "3")
+	backup()
+	secondFull := fmt.Sprintf("example.com/repo/%012d", m.lastUpdate.Unix())
+	if got := bundleNames(readChain(t, b, bundleChainFile)); !reflect.DeepEqual(got, []string{secondFull}) {
+		t.Errorf("got %v, want only the new full bundle", got)
+	}
+	if got := bundleNames(readChain(t, b, previousBundleChainFile)); !reflect.DeepEqual(got, []string{full, incremental}) {
+		t.Errorf("got the previous chain %v, want %v", got, []string{full, incremental})
+	}
+
+	// The bundles only in the chain before the previous one are deleted.
+	ageChain(t, b)
+	m.update("refs/heads/main", "4")
+	backup()
+	thirdFull := fmt.Sprintf("example.com/repo/%012d", m.lastUpdate.Unix())
+	want := []string{
+		secondFull,
+		thirdFull,
+		"example.com/repo/" + bundleChainFile,
+		"example.com/repo/" + previousBundleChainFile,
+	}
+	if got := listRepoObjects(t, store); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBackupManagedRepo_InvalidChainKeepsBundles(t *testing.T) {
+	store, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	b, cleanupRW := newTestReaderWriter(t, store)
+	defer cleanupRW()
+	m := &fakeRepository{lastUpdate: time.Unix(1000000, 0)}
+	m.update("refs/heads/main", "1")
+
+	writeObject(t, store, "example.com/repo/"+bundleChainFile, "{broken", nil)
+	writeObject(t, store, "example.com/repo/000000000001", "old bundle", nil)
+	if err := b.backupManagedRepo(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := bundleNames(readChain(t, b, bundleChainFile)); len(got) != 1 {
+		t.Errorf("got %v, want a new full bundle", got)
+	}
+	found := false
+	for _, name := range listRepoObjects(t, store) {
+		if name == "example.com/repo/000000000001" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("got the bundle of the unreadable chain deleted")
+	}
+}
+
+// failingStore fails the reads of the objects with the suffix.
+type failingStore struct {
+	ObjectStore
+	suffix string
+}
+
+func (s *failingStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	if strings.HasSuffix(name, s.suffix) {
+		return nil, errors.New("storage is unavailable")
+	}
+	return s.ObjectStore.NewReader(ctx, name)
+}
+
+func TestBackupManagedRepo_StoreError(t *testing.T) {
+	for _, chainFile := range []string{bundleChainFile, previousBundleChainFile} {
+		local, cleanup := newTestLocalObjectStore(t)
+		b, cleanupRW := newTestReaderWriter(t, local)
+		m := &fakeRepository{lastUpdate: time.Unix(1000000, 0)}
+		m.update("refs/heads/main", "1")
+		if err := b.backupManagedRepo(m); err != nil {
+			t.Fatal(err)
+		}
+		ageChain(t, b)
+		m.update("refs/heads/main", "2")
+		if err := b.backupManagedRepo(m); err != nil {
+			t.Fatal(err)
+		}
+		ageChain(t, b)
+		before := listRepoObjects(t, local)
+
+		// The backup stops without replacing the chains or deleting
+		// the bundles.
+		b.Store = &failingStore{local, chainFile}
+		m.update("refs/heads/main", "3")
+		if err := b.backupManagedRepo(m); err == nil {
+			t.Errorf("%s: got no error for the store error", chainFile)
+		}
+		if got := listRepoObjects(t, local); !reflect.DeepEqual(got, before) {
+			t.Errorf("%s: got %v, want the objects unchanged %v", chainFile, got, before)
+		}
+		cleanupRW()
+		cleanup()
+	}
+}
+
+func TestGCBundles(t *testing.T) {
+	store, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	b, cleanupRW := newTestReaderWriter(t, store)
+	defer cleanupRW()
+	for _, name := range []string{"1", "2", "2.incremental", "3", bundleChainFile, previousBundleChainFile} {
+		writeObject(t, store, "example.com/repo/"+name, name, nil)
+	}
+	writeObject(t, store, "example.com/repo/sub/1", "other repository", nil)
+
+	chain := &bundleChain{Bundles: []*chainedBundle{{Name: "example.com/repo/3"}, {}}}
+	previous := &bundleChain{Bundles: []*chainedBundle{{Name: "example.com/repo/2"}, {Name: "example.com/repo/2.incremental"}}}
+	b.gcBundles("example.com/repo", chain, previous, nil)
+	want := []string{
+		"example.com/repo/2",
+		"example.com/repo/2.incremental",
+		"example.com/repo/3",
+		"example.com/repo/" + bundleChainFile,
+		"example.com/repo/" + previousBundleChainFile,
+	}
+	if got := listRepoObjects(t, store); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := readObject(t, store, "example.com/repo/sub/1"); got != "other repository" {
+		t.Errorf("got %q, want the object in the subdirectory kept", got)
+	}
+}
+
+func TestRecoverRepository_Fallback(t *testing.T) {
+	store, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	b, cleanupRW := newTestReaderWriter(t, store)
+	defer cleanupRW()
+	m := &fakeRepository{lastUpdate: time.Unix(1000000, 0)}
+	m.update("refs/heads/main", "1")
+	if err := b.backupManagedRepo(m); err != nil {
+		t.Fatal(err)
+	}
+	ageChain(t, b)
+	m.update("refs/heads/main", "2")
+	if err := b.backupManagedRepo(m); err != nil {
+		t.Fatal(err)
+	}
+	m.update("refs/heads/dev", "3")
+	if err := b.backupManagedRepo(m); err != nil {
+		t.Fatal(err)
+	}
+	chain := readChain(t, b, bundleChainFile)
+
+	// A broken incremental bundle is skipped with the ones after it.
+	writeObject(t, store, chain.Bundles[1].Name, "broken", nil)
+	restored := &fakeRepository{}
+	if err := b.recoverRepository(restored); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2 refs/heads/main\n"}; !reflect.DeepEqual(restored.recovered, want) {
+		t.Errorf("got %q, want %q", restored.recovered, want)
+	}
+
+	// The previous chain is used if the full bundle is broken.
+	writeObject(t, store, chain.Bundles[0].Name, "broken", nil)
+	restored = &fakeRepository{}
+	if err := b.recoverRepository(restored); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1 refs/heads/main\n"}; !reflect.DeepEqual(restored.recovered, want) {
+		t.Errorf("got %q, want %q", restored.recovered, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ObjectStore is a storage of the backup bundles and manifests. The object
+// names are "/"-separated relative paths without "." or ".." elements.
+type ObjectStore interface {
+	// List returns the names of the objects that start with the prefix. The
+	// names that have "/" after the prefix are not included.
+	List(ctx context.Context, prefix string) ([]string, error)
+
+	// NewReader opens the object.
+	NewReader(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Write creates or replaces the object with the content written by
+	// write and the metadata. The object is updated atomically. If write
+	// returns an error, the object is not changed.
+	Write(ctx context.Context, name string, metadata map[string]string, write func(io.Writer) error) error
+
+	// Metadata returns the metadata of the object set by Write. The keys
+	// are lower-case.
+	Metadata(ctx context.Context, name string) (map[string]string, error)
+
+	// Delete deletes the object. Deleting a missing object is not an
+	// error.
+	Delete(ctx context.Context, name string) error
+}
+
+const (
+	localTempFilePrefix = ".goblet-tmp-"
+
+	// localMetadataFilePrefix is the prefix of the JSON file that has the
+	// metadata of the object.
+	localMetadataFilePrefix = ".goblet-metadata-"
+)
+
+// LocalObjectStore is an ObjectStore backed by a local directory, such as an
+// NFS mount.
+type LocalObjectStore struct {
+	root string
+}
+
+// NewLocalObjectStore returns an ObjectStore that stores the objects under the
+// root directory.
+func NewLocalObjectStore(root string) *LocalObjectStore {
+	return &LocalObjectStore{root: root}
+}
+
+func (s *LocalObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	dir, base := path.Split(prefix)
+	p := s.root
+	if dir != "" {
+		var err error
+		if p, err = s.path(strings.TrimSuffix(dir, "/")); err != nil {
+			return nil, err
+		}
+	}
+	fis, err := ioutil.ReadDir(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), base) || strings.HasPrefix(fi.Name(), localTempFilePrefix) || strings.HasPrefix(fi.Name(), localMetadataFilePrefix) {
+			continue
+		}
+		names = append(names, dir+fi.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *LocalObjectStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *LocalObjectStore) Write(ctx context.Context, name string, metadata map[string]string, write func(io.Writer) error) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file in the same directory and rename it so
+	// that the readers never see a partially written object.
+	f, err := ioutil.TempFile(filepath.Dir(p), localTempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.writeMetadata(p, metadata); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *LocalObjectStore) writeMetadata(p string, metadata map[string]string) error {
+	mp := localMetadataPath(p)
+	if len(metadata) == 0 {
+		if err := os.Remove(mp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	lower := map[string]string{}
+	for k, v := range metadata {
+		lower[strings.ToLower(k)] = v
+	}
+	bs, err := json.Marshal(lower)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), localTempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), mp)
+}
+
+func (s *LocalObjectStore) Metadata(ctx context.Context, name string) (map[string]string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(p); err != nil {
+		return nil, err
+	}
+	bs, err := ioutil.ReadFile(localMetadataPath(p))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{}
+	if err := json.Unmarshal(bs, &metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+func (s *LocalObjectStore) Delete(ctx context.Context, name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(localMetadataPath(p)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path returns the file path of the object. The names that can point outside
+// the root, or to the files used internally, are rejected.
+func (s *LocalObjectStore) path(name string) (string, error) {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	if base := path.Base(name); strings.HasPrefix(base, localTempFilePrefix) || strings.HasPrefix(base, localMetadataFilePrefix) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(name)), nil
+}
+
+func localMetadataPath(p string) string {
+	return filepath.Join(filepath.Dir(p), localMetadataFilePrefix+filepath.Base(p))
+}
@@ -0,0 +1,221 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestLocalObjectStore(t *testing.T) (*LocalObjectStore, func()) {
+	dir, err := ioutil.TempDir("", "goblet_backup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLocalObjectStore(dir), func() { os.RemoveAll(dir) }
+}
+
+func writeObject(t *testing.T, s ObjectStore, name, content string, metadata map[string]string) {
+	t.Helper()
+	err := s.Write(context.Background(), name, metadata, func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readObject(t *testing.T, s ObjectStore, name string) string {
+	t.Helper()
+	rc, err := s.NewReader(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	bs, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+// listFiles returns the names of the files in the directory.
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestLocalObjectStore_List(t *testing.T) {
+	s, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	for _, name := range []string{"a/b/1", "a/b/12", "a/b/2", "a/b/c/3", "a/bc/4", "a/5"} {
+		writeObject(t, s, name, name, map[string]string{"sha256": "0"})
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"a/b/", []string{"a/b/1", "a/b/12", "a/b/2"}},
+		{"a/b/1", []string{"a/b/1", "a/b/12"}},
+		{"a/b", []string{}},
+		{"a/", []string{"a/5"}},
+		{"a/b/c/", []string{"a/b/c/3"}},
+		{"", []string{}},
+		{"x/", nil},
+	}
+	for _, tc := range tests {
+		got, err := s.List(context.Background(), tc.prefix)
+		if err != nil {
+			t.Errorf("%q: %v", tc.prefix, err)
+			continue
+		}
+		if len(got) != len(tc.want) || (len(got) != 0 && !reflect.DeepEqual(got, tc.want)) {
+			t.Errorf("%q: got %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestLocalObjectStore_WriteIsAtomic(t *testing.T) {
+	s, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	writeObject(t, s, "repo/bundle", "old", map[string]string{"sha256": "old"})
+
+	errWrite := errors.New("write failed")
+	for _, name := range []string{"repo/bundle", "repo/new"} {
+		err := s.Write(context.Background(), name, map[string]string{"sha256": "new"}, func(w io.Writer) error {
+			io.WriteString(w, "partial")
+			return errWrite
+		})
+		if err != errWrite {
+			t.Errorf("%s: got %v, want %v", name, err, errWrite)
+		}
+	}
+
+	// The failed writes leave nothing behind.
+	if got := readObject(t, s, "repo/bundle"); got != "old" {
+		t.Errorf("got %q, want the old content", got)
+	}
+	if metadata, err := s.Metadata(context.Background(), "repo/bundle"); err != nil || metadata["sha256"] != "old" {
+		t.Errorf("got (%v, %v), want the old metadata", metadata, err)
+	}
+	if _, err := s.NewReader(context.Background(), "repo/new"); !os.IsNotExist(err) {
+		t.Errorf("got %v for the failed new object, want not found", err)
+	}
+	want := []string{localMetadataFilePrefix + "bundle", "bundle"}
+	if got := listFiles(t, filepath.Join(s.root, "repo")); !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+}
+
+func TestLocalObjectStore_Metadata(t *testing.T) {
+	s, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+
+	writeObject(t, s, "repo/bundle", "content", map[string]string{"SHA256": "abc"})
+	metadata, err := s.Metadata(context.Background(), "repo/bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"sha256": "abc"}; !reflect.DeepEqual(metadata, want) {
+		t.Errorf("got %v, want %v", metadata, want)
+	}
+
+	// Replacing the object without metadata removes the old metadata.
+	writeObject(t, s, "repo/bundle", "content", nil)
+	if metadata, err := s.Metadata(context.Background(), "repo/bundle"); err != nil || len(metadata) != 0 {
+		t.Errorf("got (%v, %v), want no metadata", metadata, err)
+	}
+
+	if _, err := s.Metadata(context.Background(), "repo/missing"); err == nil {
+		t.Error("got no error for a missing object")
+	}
+}
+
+func TestLocalObjectStore_Delete(t *testing.T) {
+	s, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	writeObject(t, s, "repo/bundle", "content", map[string]string{"sha256": "abc"})
+
+	if err := s.Delete(context.Background(), "repo/bundle"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listFiles(t, filepath.Join(s.root, "repo")); len(got) != 0 {
+		t.Errorf("got files %v after the delete, want none", got)
+	}
+	if err := s.Delete(context.Background(), "repo/bundle"); err != nil {
+		t.Errorf("got %v for deleting a missing object, want nil", err)
+	}
+	if err := s.Delete(context.Background(), "missing-dir/bundle"); err != nil {
+		t.Errorf("got %v for deleting in a missing directory, want nil", err)
+	}
+}
+
+func TestLocalObjectStore_InvalidNames(t *testing.T) {
+	parent, cleanup := newTestLocalObjectStore(t)
+	defer cleanup()
+	s := NewLocalObjectStore(filepath.Join(parent.root, "root"))
+	writeObject(t, parent, "secret", "secret", nil)
+
+	ctx := context.Background()
+	for _, name := range []string{
+		"",
+		"..",
+		"../secret",
+		"a/../../secret",
+		"a/./b",
+		"a//b",
+		"a/",
+		"/secret",
+		`..\secret`,
+		localTempFilePrefix + "1",
+		"a/" + localMetadataFilePrefix + "b",
+	} {
+		if _, err := s.NewReader(ctx, name); err == nil || !strings.Contains(err.Error(), "invalid object name") {
+			t.Errorf("NewReader(%q): got %v, want an invalid name error", name, err)
+		}
+		if err := s.Write(ctx, name, nil, func(io.Writer) error { return nil }); err == nil {
+			t.Errorf("Write(%q): got no error", name)
+		}
+		if _, err := s.Metadata(ctx, name); err == nil || !strings.Contains(err.Error(), "invalid object name") {
+			t.Errorf("Metadata(%q): got %v, want an invalid name error", name, err)
+		}
+		if err := s.Delete(ctx, name); err == nil {
+			t.Errorf("Delete(%q): got no error", name)
+		}
+	}
+	if _, err := s.List(ctx, "../"); err == nil {
+		t.Error("List(../): got no error")
+	}
+	if got := readObject(t, parent, "secret"); got != "secret" {
+		t.Errorf("got %q, want the file outside the root untouched", got)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3 provides a backup.ObjectStore backed by Amazon S3 or an
+// S3-compatible storage such as MinIO.
+package s3
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ObjectStore is a backup.ObjectStore backed by an S3 bucket.
+type ObjectStore struct {
+	client   s3iface.S3API
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+// NewObjectStore returns a backup.ObjectStore of the bucket. For an
+// S3-compatible storage, set the endpoint and S3ForcePathStyle in the client
+// configuration.
+func NewObjectStore(client s3iface.S3API, bucket string) *ObjectStore {
+	return &ObjectStore{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+	}
+}
+
+func (s *ObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	names := []string{}
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &awss3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Delimiter: aws.String("/"),
+		Prefix:    aws.String(prefix),
+	}, func(out *awss3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range out.Contents {
+			names = append(names, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (s *ObjectStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &awss3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *ObjectStore) Write(ctx context.Context, name string, metadata map[string]string, write func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		// If write fails, the upload fails by reading the error and
+		// the object is not created.
+		pw.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+		Body:   pr,
+	}
+	if len(metadata) != 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	// Unblock the writer if the upload stopped reading.
+	pr.CloseWithError(io.ErrClosedPipe)
+	if werr := <-writeErr; werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (s *ObjectStore) Metadata(ctx context.Context, name string) (map[string]string, error) {
+	out, err := s.client.HeadObjectWithContext(ctx, &awss3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// S3 returns the keys in the canonical header form.
+	metadata := map[string]string{}
+	for k, v := range out.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return metadata, nil
+}
+
+func (s *ObjectStore) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &awss3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(name),
+	})
+	return err
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testBucket = "goblet-backup"
+
+type fakeObject struct {
+	content  []byte
+	metadata http.Header
+}
+
+// fakeS3 serves the subset of the S3 API used by ObjectStore with the path
+// style URLs.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == testBucket && r.Method == "GET" {
+		f.list(w, r)
+		return
+	}
+	if !strings.HasPrefix(path, testBucket+"/") {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(path, testBucket+"/")
+
+	switch r.Method {
+	case "PUT":
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj := &fakeObject{content: bs, metadata: http.Header{}}
+		for k, vs := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				obj.metadata[k] = vs
+			}
+		}
+		f.objects[key] = obj
+	case "GET", "HEAD":
+		obj, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == "GET" {
+				io.WriteString(w, "<Error><Code>NoSuchKey</Code></Error>")
+			}
+			return
+		}
+		for k, vs := range obj.metadata {
+			w.Header()[k] = vs
+		}
+		if r.Method == "GET" {
+			w.Write(obj.content)
+		}
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	resp := struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{Name: testBucket, Prefix: r.URL.Query().Get("prefix")}
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, resp.Prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(resp.Prefix):], "/"); i >= 0 {
+			p := key[:len(resp.Prefix)+i+1]
+			if !seen[p] {
+				seen[p] = true
+				resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{p})
+			}
+			continue
+		}
+		resp.Contents = append(resp.Contents, content{key})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func newTestObjectStore(t *testing.T) (*ObjectStore, *fakeS3, func()) {
+	f := &fakeS3{objects: map[string]*fakeObject{}}
+	s := httptest.NewServer(f)
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(s.URL).
+		WithRegion("us-east-1").
+		WithS3ForcePathStyle(true).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return NewObjectStore(awss3.New(sess), testBucket), f, s.Close
+}
+
+func writeObject(t *testing.T, s *ObjectStore, name, content string, metadata map[string]string) {
+	t.Helper()
+	err := s.Write(context.Background(), name, metadata, func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestObjectStore_WriteAndRead(t *testing.T) {
+	s, _, cleanup := newTestObjectStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	writeObject(t, s, "example.com/repo/1", "bundle", map[string]string{"sha256": "abc"})
+	rc, err := s.NewReader(ctx, "example.com/repo/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "bundle" {
+		t.Errorf("got %q, want bundle", bs)
+	}
+
+	metadata, err := s.Metadata(ctx, "example.com/repo/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"sha256": "abc"}; !reflect.DeepEqual(metadata, want) {
+		t.Errorf("got metadata %v, want %v", metadata, want)
+	}
+
+	if _, err := s.NewReader(ctx, "example.com/repo/missing"); err == nil {
+		t.Error("got no error for a missing object")
+	}
+}
+
+func TestObjectStore_WriteError(t *testing.T) {
+	s, f, cleanup := newTestObjectStore(t)
+	defer cleanup()
+
+	errWrite := errors.New("write failed")
+	err := s.Write(context.Background(), "example.com/repo/1", nil, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errWrite
+	})
+	if err != errWrite {
+		t.Errorf("got %v, want %v", err, errWrite)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("got objects %v after the failed write, want none", f.objects)
+	}
+}
+
+func TestObjectStore_ListAndDelete(t *testing.T) {
+	s, _, cleanup := newTestObjectStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	for _, name := range []string{"a/b/1", "a/b/12", "a/b/c/3", "a/bc/4"} {
+		writeObject(t, s, name, name, nil)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"a/b/", []string{"a/b/1", "a/b/12"}},
+		{"a/b/1", []string{"a/b/1", "a/b/12"}},
+		{"a/", []string{}},
+	}
+	for _, tc := range tests {
+		got, err := s.List(ctx, tc.prefix)
+		if err != nil {
+			t.Errorf("%q: %v", tc.prefix, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.prefix, got, tc.want)
+		}
+	}
+
+	if err := s.Delete(ctx, "a/b/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "a/b/1"); err != nil {
+		t.Errorf("got %v for deleting a missing object, want nil", err)
+	}
+	if got, err := s.List(ctx, "a/b/"); err != nil || !reflect.DeepEqual(got, []string{"a/b/12"}) {
+		t.Errorf("got (%v, %v) after the delete, want [a/b/12]", got, err)
+	}
+}
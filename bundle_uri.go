@@ -0,0 +1,122 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// With the bundle-uri command, a client downloads a bundle as a static file
+// before fetching, and then fetches only the objects that are not in the
+// bundle. This moves most of the fresh clone traffic out of upload-pack.
+//
+// Goblet creates a bundle of the local cache in the repository directory, and
+// serves it at "REPOSITORY_URL/goblet-bundle". The bundle is created in the
+// background so that the bundle-uri command doesn't wait for it. Until the
+// first bundle is created, the bundle list is empty.
+
+const (
+	bundleURISuffix = "/goblet-bundle"
+
+	bundleURIFile = "goblet-bundle-uri.bundle"
+)
+
+// clientRepositoryURL returns the repository URL that the client uses to
+// access Goblet.
+func clientRepositoryURL(r *http.Request) *url.URL {
+	u := &url.URL{
+		Scheme: r.URL.Scheme,
+		Host:   r.URL.Host,
+		Path:   trimGitEndpointSuffix(r.URL.Path),
+	}
+	if u.Host == "" {
+		// Not a proxy request.
+		u.Host = r.Host
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			u.Scheme = proto
+		}
+	}
+	return u
+}
+
+// bundleURIList returns the bundle-uri response. The bundle URI is made from
+// clientURL.
+func (r *managedRepository) bundleURIList(clientURL *url.URL) []*gitprotocolio.ProtocolV2ResponseChunk {
+	resp := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	info, err := os.Stat(filepath.Join(r.localDiskPath, bundleURIFile))
+	if err != nil || time.Since(info.ModTime()) > r.config.BundleURITTL {
+		// The error is reported by the operation.
+		r.uriBundleJob.start(func() { r.writeURIBundle() })
+	}
+	if err == nil {
+		uri := *clientURL
+		uri.Path += bundleURISuffix
+		for _, line := range []string{
+			"bundle.version=1",
+			"bundle.mode=all",
+			"bundle.heuristic=creationToken",
+			"bundle.goblet.uri=" + uri.String(),
+			fmt.Sprintf("bundle.goblet.creationToken=%d", info.ModTime().Unix()),
+		} {
+			resp = append(resp, &gitprotocolio.ProtocolV2ResponseChunk{Response: []byte(line + "\n")})
+		}
+	}
+	return append(resp, &gitprotocolio.ProtocolV2ResponseChunk{EndResponse: true})
+}
+
+func (r *managedRepository) writeURIBundle() error {
+	f, err := ioutil.TempFile(r.localDiskPath, "tmp-bundle-uri-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := r.WriteBundle(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(r.localDiskPath, bundleURIFile))
+}
+
+// bundleHandler serves the bundle advertised by bundle-uri.
+func (s *httpProxyServer) bundleHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	if s.config.BundleURITTL == 0 {
+		reporter.reportError(status.Error(codes.NotFound, "bundle-uri is disabled"))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only GET"))
+		return
+	}
+
+	s.serveRepositoryFile(reporter, w, r, strings.TrimSuffix(r.URL.Path, bundleURISuffix), bundleURIFile)
+}
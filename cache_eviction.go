@@ -0,0 +1,236 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/stats"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	errRepositoryEvicted = status.Error(codes.Unavailable, "the repository has been evicted from the cache")
+
+	// evictionRunning is 1 while enforceCacheDiskQuota is running.
+	evictionRunning int32
+
+	// cacheDiskQuotaCheckInterval is the minimum interval between the
+	// scans of a cache root.
+	cacheDiskQuotaCheckInterval = time.Minute
+
+	cacheDiskQuotaMu sync.Mutex
+	// cacheDiskQuotaChecks is keyed by the cache root. Guarded by
+	// cacheDiskQuotaMu.
+	cacheDiskQuotaChecks = map[string]*cacheDiskQuotaCheck{}
+)
+
+type cacheDiskQuotaCheck struct {
+	scheduled bool
+	lastRun   time.Time
+}
+
+func (r *managedRepository) touch() {
+	atomic.StoreInt64(&r.lastAccess, time.Now().UnixNano())
+}
+
+// evict removes the repository from the disk and from the managed
+// repositories.
+func (r *managedRepository) evict() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.evicted {
+		return nil
+	}
+	r.evicted = true
+	// Remove the directory before forgetting the repository. Otherwise a
+	// new instance can be created for the directory being removed.
+	err := os.RemoveAll(r.localDiskPath)
+	managedRepos.Delete(r.localDiskPath)
+	addGauge(ManagedRepositoryCount, &managedRepositoryCount, -1)
+	return err
+}
+
+type cachedRepositoryUsage struct {
+	localDiskPath string
+	size          int64
+	lastAccess    time.Time
+}
+
+// scheduleCacheDiskQuotaCheck runs enforceCacheDiskQuota in the background if
+// the quota is set. The calls are coalesced so that the cache root is scanned
+// at most once every cacheDiskQuotaCheckInterval.
+func scheduleCacheDiskQuotaCheck(config *ServerConfig) {
+	if config.CacheDiskQuotaBytes <= 0 {
+		return
+	}
+	cacheDiskQuotaMu.Lock()
+	defer cacheDiskQuotaMu.Unlock()
+	c, ok := cacheDiskQuotaChecks[config.LocalDiskCacheRoot]
+	if !ok {
+		c = &cacheDiskQuotaCheck{}
+		cacheDiskQuotaChecks[config.LocalDiskCacheRoot] = c
+	}
+	if c.scheduled {
+		return
+	}
+	c.scheduled = true
+	time.AfterFunc(cacheDiskQuotaCheckInterval-time.Since(c.lastRun), func() {
+		cacheDiskQuotaMu.Lock()
+		c.scheduled = false
+		c.lastRun = time.Now()
+		cacheDiskQuotaMu.Unlock()
+		enforceCacheDiskQuota(config)
+	})
+}
+
+// enforceCacheDiskQuota records the disk usage of the cache, and evicts the
+// least recently used repositories until it fits in
+// ServerConfig.CacheDiskQuotaBytes.
+//
+// The repositories that exist on the disk but are not opened since the
+// server start are also evicted based on their modification time.
+func enforceCacheDiskQuota(config *ServerConfig) {
+	if config.CacheDiskQuotaBytes <= 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&evictionRunning, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&evictionRunning, 0)
+
+	repos, total, err := scanCachedRepositories(config.LocalDiskCacheRoot)
+	if err != nil {
+		log.Printf("Cannot calculate the disk usage of the cache: %v", err)
+		return
+	}
+	stats.Record(context.Background(), CacheDiskUsage.M(total))
+	if total <= config.CacheDiskQuotaBytes || len(repos) == 0 {
+		return
+	}
+
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].lastAccess.Before(repos[j].lastAccess)
+	})
+	// Keep the most recently used one even if it alone exceeds the quota.
+	// Otherwise, it's evicted right after it's fetched.
+	for _, u := range repos[:len(repos)-1] {
+		if total <= config.CacheDiskQuotaBytes {
+			break
+		}
+		m, err := loadManagedRepo(config, u.localDiskPath)
+		if err != nil {
+			log.Printf("Cannot load the cached repository %s for eviction: %v", u.localDiskPath, err)
+			continue
+		}
+		if err := m.evict(); err != nil {
+			log.Printf("Cannot evict %s: %v", u.localDiskPath, err)
+			continue
+		}
+		total -= u.size
+		stats.Record(context.Background(), CacheEvictionCount.M(1))
+	}
+	stats.Record(context.Background(), CacheDiskUsage.M(total))
+}
+
+// scanCachedRepositories returns the disk usage of each repository under the
+// cache root and the total disk usage.
+func scanCachedRepositories(root string) ([]*cachedRepositoryUsage, int64, error) {
+	repos := []*cachedRepositoryUsage{}
+	var total int64
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while walking.
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+			return nil
+		}
+		if !isBareRepository(path) {
+			return nil
+		}
+		u := &cachedRepositoryUsage{localDiskPath: path, lastAccess: info.ModTime()}
+		if fi, err := os.Stat(filepath.Join(path, "FETCH_HEAD")); err == nil {
+			u.lastAccess = fi.ModTime()
+		}
+		if v, ok := managedRepos.Load(path); ok {
+			if t := atomic.LoadInt64(&v.(*managedRepository).lastAccess); t != 0 {
+				u.lastAccess = time.Unix(0, t)
+			}
+		}
+		u.size = diskUsage(path)
+		total += u.size
+		repos = append(repos, u)
+		return filepath.SkipDir
+	})
+	return repos, total, err
+}
+
+func isBareRepository(path string) bool {
+	if fi, err := os.Stat(filepath.Join(path, "objects")); err != nil || !fi.IsDir() {
+		return false
+	}
+	if fi, err := os.Stat(filepath.Join(path, "HEAD")); err != nil || fi.IsDir() {
+		return false
+	}
+	return true
+}
+
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// loadManagedRepo returns the managed repository for the local disk path. If
+// the repository is not opened since the server start, the upstream URL is
+// read from the repository config.
+func loadManagedRepo(config *ServerConfig, localDiskPath string) (*managedRepository, error) {
+	if v, ok := managedRepos.Load(localDiskPath); ok {
+		return v.(*managedRepository), nil
+	}
+	cmd := exec.Command(gitBinary, "config", "--get", "remote.origin.url")
+	cmd.Env = []string{}
+	cmd.Dir = localDiskPath
+	bs, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return nil, err
+	}
+	return getManagedRepo(localDiskPath, u, config), nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newEvictionTestRepositories creates the bare repositories under a cache
+// root. The i-th repository is accessed at the i-th of the accessTimes.
+func newEvictionTestRepositories(t *testing.T, accessTimes ...time.Time) (*ServerConfig, []*managedRepository, func()) {
+	root, err := ioutil.TempDir("", "goblet_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ServerConfig{LocalDiskCacheRoot: root}
+	repos := []*managedRepository{}
+	cleanup := func() {
+		for _, r := range repos {
+			managedRepos.Delete(r.localDiskPath)
+		}
+		os.RemoveAll(root)
+	}
+	for i, accessTime := range accessTimes {
+		u := &url.URL{Scheme: "https", Host: "example.com", Path: fmt.Sprintf("/repo%d", i)}
+		dir := filepath.Join(root, u.Host, u.Path)
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		gitCommand(t, dir, "init", "--bare", "-q")
+		gitCommand(t, dir, "remote", "add", "origin", u.String())
+		if err := ioutil.WriteFile(filepath.Join(dir, "objects", "data"), []byte(strings.Repeat("x", 4096)), 0640); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		r := getManagedRepo(dir, u, config)
+		atomic.StoreInt64(&r.lastAccess, accessTime.UnixNano())
+		repos = append(repos, r)
+	}
+	return config, repos, cleanup
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestEnforceCacheDiskQuota_LastAccessOrder(t *testing.T) {
+	now := time.Now()
+	config, repos, cleanup := newEvictionTestRepositories(t,
+		now.Add(-2*time.Hour),
+		now,
+		now.Add(-3*time.Hour),
+		now.Add(-time.Hour),
+	)
+	defer cleanup()
+
+	// Only the two most recently used ones fit.
+	config.CacheDiskQuotaBytes = diskUsage(repos[1].localDiskPath) + diskUsage(repos[3].localDiskPath)
+	enforceCacheDiskQuota(config)
+
+	for i, wantEvicted := range []bool{true, false, true, false} {
+		r := repos[i]
+		if got := !exists(r.localDiskPath); got != wantEvicted {
+			t.Errorf("repo%d: got removed %v, want %v", i, got, wantEvicted)
+		}
+		if r.evicted != wantEvicted {
+			t.Errorf("repo%d: got evicted %v, want %v", i, r.evicted, wantEvicted)
+		}
+		if _, ok := managedRepos.Load(r.localDiskPath); ok == wantEvicted {
+			t.Errorf("repo%d: got managed %v, want %v", i, ok, !wantEvicted)
+		}
+	}
+}
+
+func TestEnforceCacheDiskQuota_StopsUnderQuota(t *testing.T) {
+	now := time.Now()
+	config, repos, cleanup := newEvictionTestRepositories(t,
+		now.Add(-3*time.Hour),
+		now.Add(-2*time.Hour),
+		now.Add(-time.Hour),
+		now,
+	)
+	defer cleanup()
+
+	_, total, err := scanCachedRepositories(config.LocalDiskCacheRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Evicting the least recently used one is enough.
+	config.CacheDiskQuotaBytes = total - diskUsage(repos[0].localDiskPath)
+	enforceCacheDiskQuota(config)
+	for i, r := range repos {
+		if got, want := !exists(r.localDiskPath), i == 0; got != want {
+			t.Errorf("repo%d: got removed %v, want %v", i, got, want)
+		}
+	}
+
+	// Nothing is evicted while the usage is under the quota.
+	enforceCacheDiskQuota(config)
+	for i, r := range repos[1:] {
+		if !exists(r.localDiskPath) {
+			t.Errorf("repo%d: got removed under the quota", i+1)
+		}
+	}
+
+	// The most recently used one is kept even if it alone exceeds the
+	// quota.
+	config.CacheDiskQuotaBytes = 1
+	enforceCacheDiskQuota(config)
+	for i, r := range repos {
+		if got, want := !exists(r.localDiskPath), i != 3; got != want {
+			t.Errorf("repo%d: got removed %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestEnforceCacheDiskQuota_WaitsForInFlightRequests(t *testing.T) {
+	now := time.Now()
+	config, repos, cleanup := newEvictionTestRepositories(t, now.Add(-time.Hour), now)
+	defer cleanup()
+	config.CacheDiskQuotaBytes = 1
+	r := repos[0]
+
+	unlock := r.readLock()
+	done := make(chan struct{})
+	go func() {
+		enforceCacheDiskQuota(config)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("got the eviction done while a request is in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !exists(r.localDiskPath) || r.evicted {
+		t.Error("got the repository removed while a request is in flight")
+	}
+	unlock()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("got no eviction after the request is done")
+	}
+	if exists(r.localDiskPath) {
+		t.Error("got the repository kept after the request is done")
+	}
+
+	// A fetch that starts after the eviction doesn't recreate the
+	// repository.
+	if err := r.fetchUpstream(context.Background()); err == nil {
+		t.Error("got no error for fetching an evicted repository")
+	}
+	if exists(r.localDiskPath) {
+		t.Error("got the evicted repository recreated by a fetch")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Credential is a credential used to access an upstream repository. If
+// BearerToken is set, it's sent as a Bearer token. Otherwise, if Username or
+// Password is set, they are sent with the Basic scheme.
+type Credential struct {
+	BearerToken string
+	Username    string
+	Password    string
+}
+
+// AuthorizationHeader returns the value of the Authorization header. This
+// returns an empty string if there's nothing to send.
+func (c *Credential) AuthorizationHeader() string {
+	if c == nil {
+		return ""
+	}
+	if c.BearerToken != "" {
+		return "Bearer " + c.BearerToken
+	}
+	if c.Username != "" || c.Password != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	}
+	return ""
+}
+
+// CredentialProvider returns a credential for a canonical upstream URL. A nil
+// credential means that the upstream is accessed without authentication.
+type CredentialProvider interface {
+	Credential(*url.URL) (*Credential, error)
+}
+
+// CredentialProviderFunc is an adapter to use a function as a
+// CredentialProvider.
+type CredentialProviderFunc func(*url.URL) (*Credential, error)
+
+func (f CredentialProviderFunc) Credential(u *url.URL) (*Credential, error) {
+	return f(u)
+}
+
+// NewTokenSourceCredentialProvider returns a CredentialProvider that uses the
+// OAuth2 access token as a Bearer token for all upstreams.
+func NewTokenSourceCredentialProvider(ts oauth2.TokenSource) CredentialProvider {
+	return CredentialProviderFunc(func(*url.URL) (*Credential, error) {
+		t, err := ts.Token()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+		}
+		return &Credential{BearerToken: t.AccessToken}, nil
+	})
+}
+
+// NewStaticCredentialProvider returns a CredentialProvider that returns the
+// same credential for all upstreams.
+func NewStaticCredentialProvider(c *Credential) CredentialProvider {
+	return CredentialProviderFunc(func(*url.URL) (*Credential, error) {
+		return c, nil
+	})
+}
+
+// URLPrefixCredentialProvider selects a CredentialProvider by the longest URL
+// prefix (e.g. "https://github.com/myorg/") that matches the upstream URL. The
+// scheme and the host must be the same, and the path matches only on the "/"
+// boundaries, so "https://github.com/myorg" doesn't match
+// "https://github.com/myorg-other/repo". An empty prefix matches all URLs. The
+// upstream URLs that don't match any prefix are accessed without
+// authentication.
+type URLPrefixCredentialProvider map[string]CredentialProvider
+
+func (m URLPrefixCredentialProvider) Credential(u *url.URL) (*Credential, error) {
+	longest := ""
+	var provider CredentialProvider
+	for prefix, p := range m {
+		if matchesURLPrefix(u, prefix) && (provider == nil || len(prefix) > len(longest)) {
+			longest = prefix
+			provider = p
+		}
+	}
+	if provider == nil {
+		return nil, nil
+	}
+	return provider.Credential(u)
+}
+
+func matchesURLPrefix(u *url.URL, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	pu, err := url.Parse(prefix)
+	if err != nil || pu.Host == "" {
+		return false
+	}
+	if !strings.EqualFold(pu.Scheme, u.Scheme) || !strings.EqualFold(pu.Host, u.Host) {
+		return false
+	}
+	p := strings.TrimSuffix(pu.Path, "/")
+	return p == "" || u.Path == p || strings.HasPrefix(u.Path, p+"/")
+}
+
+func (r *managedRepository) upstreamCredential() (*Credential, error) {
+	if r.config.CredentialProvider != nil {
+		return r.config.CredentialProvider.Credential(r.upstreamURL)
+	}
+	return NewTokenSourceCredentialProvider(r.config.TokenSource).Credential(r.upstreamURL)
+}
+
+// gitAuthArgs returns the git command line options to send the credential.
+func gitAuthArgs(c *Credential) []string {
+	if h := c.AuthorizationHeader(); h != "" {
+		return []string{"-c", "http.extraHeader=Authorization: " + h}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestURLPrefixCredentialProvider(t *testing.T) {
+	cred := func(token string) CredentialProvider {
+		return NewStaticCredentialProvider(&Credential{BearerToken: token})
+	}
+	tests := []struct {
+		name     string
+		provider URLPrefixCredentialProvider
+		url      string
+		want     string
+	}{
+		{
+			name:     "longest prefix",
+			provider: URLPrefixCredentialProvider{"": cred("all"), "https://github.com/": cred("github"), "https://github.com/myorg/": cred("myorg")},
+			url:      "https://github.com/myorg/repo",
+			want:     "myorg",
+		},
+		{
+			name:     "shorter prefix",
+			provider: URLPrefixCredentialProvider{"": cred("all"), "https://github.com/": cred("github"), "https://github.com/myorg/": cred("myorg")},
+			url:      "https://github.com/other/repo",
+			want:     "github",
+		},
+		{
+			name:     "empty prefix",
+			provider: URLPrefixCredentialProvider{"": cred("all"), "https://github.com/": cred("github")},
+			url:      "https://gitlab.example.com/repo",
+			want:     "all",
+		},
+		{
+			name:     "prefix without a trailing slash",
+			provider: URLPrefixCredentialProvider{"https://github.com/myorg": cred("myorg")},
+			url:      "https://github.com/myorg/repo",
+			want:     "myorg",
+		},
+		{
+			name:     "exact path",
+			provider: URLPrefixCredentialProvider{"https://github.com/myorg/repo": cred("repo")},
+			url:      "https://github.com/myorg/repo",
+			want:     "repo",
+		},
+		{
+			name:     "host without a path",
+			provider: URLPrefixCredentialProvider{"https://git.example.com": cred("example")},
+			url:      "https://git.example.com/repo",
+			want:     "example",
+		},
+		{
+			name:     "host case",
+			provider: URLPrefixCredentialProvider{"https://Git.Example.com/": cred("example")},
+			url:      "https://git.example.com/repo",
+			want:     "example",
+		},
+		{
+			name:     "sibling owner",
+			provider: URLPrefixCredentialProvider{"https://github.com/myorg": cred("myorg")},
+			url:      "https://github.com/myorg-evil/repo",
+		},
+		{
+			name:     "sibling owner with a less specific prefix",
+			provider: URLPrefixCredentialProvider{"https://github.com/": cred("github"), "https://github.com/myorg": cred("myorg")},
+			url:      "https://github.com/myorg-evil/repo",
+			want:     "github",
+		},
+		{
+			name:     "host suffix",
+			provider: URLPrefixCredentialProvider{"https://git.example.com": cred("example")},
+			url:      "https://git.example.com.attacker.net/repo",
+		},
+		{
+			name:     "port",
+			provider: URLPrefixCredentialProvider{"https://git.example.com": cred("example")},
+			url:      "https://git.example.com:8443/repo",
+		},
+		{
+			name:     "scheme",
+			provider: URLPrefixCredentialProvider{"https://git.example.com/": cred("example")},
+			url:      "http://git.example.com/repo",
+		},
+		{
+			name:     "no match",
+			provider: URLPrefixCredentialProvider{"https://github.com/": cred("github")},
+			url:      "https://gitlab.example.com/repo",
+		},
+		{
+			name:     "no provider",
+			provider: URLPrefixCredentialProvider{},
+			url:      "https://github.com/myorg/repo",
+		},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := tc.provider.Credential(u)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		got := ""
+		if c != nil {
+			got = c.BearerToken
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
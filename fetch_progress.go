@@ -0,0 +1,197 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	// maxSideBandPayload is the maximum payload size of side-band-64k.
+	maxSideBandPayload = 65515
+
+	sideBandProgress = 2
+	sideBandError    = 3
+)
+
+var (
+	// progressKeepAliveInterval is the interval of the keep-alive packets.
+	// This is a variable for testing.
+	progressKeepAliveInterval = 5 * time.Second
+
+	packfileSectionHeader = (&gitprotocolio.ProtocolV2ResponseChunk{Response: []byte("packfile\n")}).EncodeToPktLine()
+)
+
+// canSendProgressBeforeFetch returns true if the fetch response for the
+// command is known to start with the packfile section.
+//
+// The packfile section is sideband-multiplexed, and the progress messages
+// and the keep-alive packets can be sent there while the upstream fetch is
+// running. This is possible only if the client has sent "done" and none of
+// the other sections (acknowledgments, shallow-info, wanted-refs, and
+// packfile-uris) will be sent. With sideband-all, the section header is also
+// multiplexed, and it's not supported.
+func canSendProgressBeforeFetch(command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	hasDone := false
+	for _, ch := range command {
+		if ch.Argument == nil {
+			continue
+		}
+		s := strings.TrimSpace(string(ch.Argument))
+		switch {
+		case s == "done":
+			hasDone = true
+		case strings.HasPrefix(s, "shallow "),
+			strings.HasPrefix(s, "deepen"),
+			strings.HasPrefix(s, "want-ref "),
+			strings.HasPrefix(s, "packfile-uris "),
+			s == "sideband-all":
+			return false
+		}
+	}
+	return hasDone
+}
+
+// fetchProgressRelay sends the upstream fetch progress and the keep-alive
+// packets to the client while the request is waiting for the upstream fetch.
+type fetchProgressRelay struct {
+	w    io.Writer
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startFetchProgressRelay writes the packfile section header and starts
+// relaying the progress messages of the repository's upstream fetch.
+func startFetchProgressRelay(w io.Writer, repo *managedRepository) (*fetchProgressRelay, error) {
+	if _, err := w.Write(packfileSectionHeader); err != nil {
+		return nil, err
+	}
+	p := &fetchProgressRelay{
+		w:    w,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	msgs, unsubscribe := repo.subscribeFetchProgress()
+	go func() {
+		defer close(p.done)
+		defer unsubscribe()
+		ticker := time.NewTicker(progressKeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case msg := <-msgs:
+				// Client-side IO errors are detected by the
+				// request context.
+				p.writeSideBand(sideBandProgress, []byte(msg))
+			case <-ticker.C:
+				// An empty packet in the data band is a
+				// keep-alive.
+				writePacket(w, gitprotocolio.SideBandMainPacket(nil))
+			}
+		}
+	}()
+	return p, nil
+}
+
+func (p *fetchProgressRelay) writeSideBand(band byte, b []byte) {
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxSideBandPayload {
+			n = maxSideBandPayload
+		}
+		var pkt gitprotocolio.Packet
+		switch band {
+		case sideBandProgress:
+			pkt = gitprotocolio.SideBandReportPacket(b[:n])
+		case sideBandError:
+			pkt = gitprotocolio.SideBandErrorPacket(b[:n])
+		}
+		if err := writePacket(p.w, pkt); err != nil {
+			return
+		}
+		b = b[n:]
+	}
+}
+
+// finish stops relaying. If err is not nil, it is sent to the client as a
+// fatal error. Otherwise, this returns a writer for the git-upload-pack
+// output, which omits the packfile section header that has been sent.
+func (p *fetchProgressRelay) finish(err error) io.Writer {
+	close(p.stop)
+	<-p.done
+	if err != nil {
+		p.writeSideBand(sideBandError, []byte(fmt.Sprintf("error: %v\n", err)))
+		return nil
+	}
+	return &prefixSkippingWriter{w: p.w, prefix: packfileSectionHeader}
+}
+
+// prefixSkippingWriter drops the prefix from the beginning of the output.
+type prefixSkippingWriter struct {
+	w       io.Writer
+	prefix  []byte
+	matched int
+	done    bool
+}
+
+func (w *prefixSkippingWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return w.w.Write(p)
+	}
+	n := len(p)
+	for len(p) > 0 && w.matched < len(w.prefix) {
+		if p[0] != w.prefix[w.matched] {
+			// Not a prefix. Write out what has been held.
+			w.done = true
+			if _, err := w.w.Write(w.prefix[:w.matched]); err != nil {
+				return 0, err
+			}
+			if _, err := w.w.Write(p); err != nil {
+				return 0, err
+			}
+			return n, nil
+		}
+		w.matched++
+		p = p[1:]
+	}
+	if w.matched == len(w.prefix) {
+		w.done = true
+		if len(p) > 0 {
+			if _, err := w.w.Write(p); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// progressPublishingOperation relays the progress messages of an operation
+// to the requests subscribing to them.
+type progressPublishingOperation struct {
+	RunningOperation
+	r *managedRepository
+}
+
+func (op *progressPublishingOperation) Printf(format string, a ...interface{}) {
+	op.RunningOperation.Printf(format, a...)
+	op.r.publishFetchProgress(fmt.Sprintf(format, a...))
+}
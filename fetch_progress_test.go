@@ -0,0 +1,185 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+// syncBuffer is a bytes.Buffer that can be written by the relay goroutine
+// while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// waitForBytes waits until the buffer contains the bytes.
+func (b *syncBuffer) waitForBytes(t *testing.T, want []byte) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !bytes.Contains(b.Bytes(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, want it to contain %q", b.Bytes(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func v2Command(args ...string) []*gitprotocolio.ProtocolV2RequestChunk {
+	command := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{EndCapability: true},
+	}
+	for _, arg := range args {
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(arg + "\n")})
+	}
+	return append(command, &gitprotocolio.ProtocolV2RequestChunk{EndRequest: true})
+}
+
+func TestCanSendProgressBeforeFetch(t *testing.T) {
+	want := "want 0123456789012345678901234567890123456789"
+	tests := []struct {
+		name    string
+		command []*gitprotocolio.ProtocolV2RequestChunk
+		want    bool
+	}{
+		{"done", v2Command(want, "ofs-delta", "done"), true},
+		{"negotiation", v2Command(want, "have 0123456789012345678901234567890123456789"), false},
+		{"shallow", v2Command(want, "shallow 0123456789012345678901234567890123456789", "done"), false},
+		{"deepen", v2Command(want, "deepen 1", "done"), false},
+		{"deepen-since", v2Command(want, "deepen-since 1234567890", "done"), false},
+		{"want-ref", v2Command("want-ref refs/heads/main", "done"), false},
+		{"packfile-uris", v2Command(want, "packfile-uris https", "done"), false},
+		{"sideband-all", v2Command(want, "sideband-all", "done"), false},
+	}
+	for _, tc := range tests {
+		if got := canSendProgressBeforeFetch(tc.command); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFetchProgressRelay(t *testing.T) {
+	defer func(d time.Duration) { progressKeepAliveInterval = d }(progressKeepAliveInterval)
+	progressKeepAliveInterval = 200 * time.Millisecond
+	keepAlive := gitprotocolio.SideBandMainPacket(nil).EncodeToPktLine()
+
+	repo := &managedRepository{}
+	w := &syncBuffer{}
+	startTime := time.Now()
+	relay, err := startFetchProgressRelay(w, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Bytes(); !bytes.Equal(got, packfileSectionHeader) {
+		t.Errorf("got %q, want only the packfile section header", got)
+	}
+
+	w.waitForBytes(t, keepAlive)
+	if d := time.Since(startTime); d < progressKeepAliveInterval {
+		t.Errorf("got a keep-alive packet after %v, want after %v", d, progressKeepAliveInterval)
+	}
+
+	repo.publishFetchProgress("Receiving objects: 100%\n")
+	progress := gitprotocolio.SideBandReportPacket("Receiving objects: 100%\n").EncodeToPktLine()
+	w.waitForBytes(t, progress)
+
+	pw := relay.finish(nil)
+	sent := len(w.Bytes())
+	time.Sleep(2 * progressKeepAliveInterval)
+	if got := w.Bytes()[sent:]; len(got) != 0 {
+		t.Errorf("got %q after finish, want nothing", got)
+	}
+
+	// The packfile section header written by git-upload-pack is skipped.
+	data := gitprotocolio.SideBandMainPacket("PACK").EncodeToPktLine()
+	if _, err := pw.Write(append(append([]byte(nil), packfileSectionHeader...), data...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Bytes()[sent:]; !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
+
+func TestFetchProgressRelay_Error(t *testing.T) {
+	w := &syncBuffer{}
+	relay, err := startFetchProgressRelay(w, &managedRepository{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pw := relay.finish(errors.New("upstream is down")); pw != nil {
+		t.Error("got a writer for a failed fetch")
+	}
+	want := append(append([]byte(nil), packfileSectionHeader...), gitprotocolio.SideBandErrorPacket("error: upstream is down\n").EncodeToPktLine()...)
+	if got := w.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPrefixSkippingWriter(t *testing.T) {
+	prefix := string(packfileSectionHeader)
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"prefix only", []string{prefix}, ""},
+		{"one write", []string{prefix + "0009data\n"}, "0009data\n"},
+		{"split prefix", []string{prefix[:3], prefix[3:7], prefix[7:] + "0009data\n"}, "0009data\n"},
+		{"byte by byte", splitBytes(prefix + "0000"), "0000"},
+		{"split after prefix", []string{prefix, "0009da", "ta\n"}, "0009data\n"},
+		{"no prefix", []string{"0008NAK\n"}, "0008NAK\n"},
+		{"partial prefix", []string{prefix[:5], "ledgments\n"}, prefix[:5] + "ledgments\n"},
+		{"prefix later", []string{"0000", prefix}, "0000" + prefix},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		w := &prefixSkippingWriter{w: &buf, prefix: packfileSectionHeader}
+		for _, s := range tc.writes {
+			if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+				t.Errorf("%s: got (%d, %v), want (%d, nil)", tc.name, n, err, len(s))
+			}
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func splitBytes(s string) []string {
+	var ret []string
+	for i := range s {
+		ret = append(ret, s[i:i+1])
+	}
+	return ret
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/gitprotocolio"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// v1UploadPackCapabilities is a list of capabilities advertised to the
+	// protocol v0/v1 clients. The local git-upload-pack runs with
+	// uploadpack.allowAnySHA1InWant, and it can serve all of them.
+	v1UploadPackCapabilities = []string{
+		"multi_ack",
+		"thin-pack",
+		"side-band",
+		"side-band-64k",
+		"ofs-delta",
+		"shallow",
+		"deepen-since",
+		"deepen-not",
+		"deepen-relative",
+		"no-progress",
+		"include-tag",
+		"multi_ack_detailed",
+		"allow-tip-sha1-in-want",
+		"allow-reachable-sha1-in-want",
+		"no-done",
+		"filter",
+	}
+
+	// lsRefsForV1Advertisement is a protocol v2 ls-refs command that
+	// returns enough information to construct the protocol v0/v1 ref
+	// advertisement.
+	lsRefsForV1Advertisement = []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndCapability: true},
+		{Argument: []byte("symrefs")},
+		{Argument: []byte("peel")},
+		{EndArgument: true},
+	}
+)
+
+// handleV1UploadPack serves a protocol v0/v1 git-upload-pack request. Like
+// the protocol v2 fetch, this fetches from the upstream if the local cache
+// doesn't have all the wanted objects.
+func handleV1UploadPack(ctx context.Context, reporter gitProtocolErrorReporter, repo *managedRepository, request []byte, w io.Writer) bool {
+	startTime := time.Now()
+	ctx, span := trace.StartSpan(ctx, "goblet/command/fetch")
+	defer span.End()
+	var err error
+	ctx, err = tag.New(ctx, tag.Upsert(CommandTypeKey, "fetch"), tag.Upsert(CommandCacheStateKey, "locally-served"))
+	if err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+
+	wantHashes, err := parseV1UploadPackWants(request)
+	if err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+
+	if hasAllWants, err := repo.hasAllWants(wantHashes, nil); err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	} else if !hasAllWants {
+		span.AddAttributes(trace.StringAttribute("goblet.cache_state", "queried-upstream"))
+		ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upsteam"))
+		if err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+
+		if err := repo.fetchUntilHasAllWants(ctx, wantHashes, nil); err != nil {
+			reporter.reportError(ctx, startTime, err)
+			return false
+		}
+	}
+
+	_, serveSpan := trace.StartSpan(ctx, "goblet/serve-fetch-local")
+	err = repo.serveUploadPackV1Local(request, w)
+	endSpan(serveSpan, err)
+	if err != nil {
+		reporter.reportError(ctx, startTime, err)
+		return false
+	}
+	reporter.reportError(ctx, startTime, nil)
+	return true
+}
+
+// v1RefAdvertisement converts a protocol v2 ls-refs response to a protocol
+// v0/v1 ref advertisement.
+func v1RefAdvertisement(resp []*gitprotocolio.ProtocolV2ResponseChunk, version int) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+	chunks := []*gitprotocolio.InfoRefsResponseChunk{
+		{ServiceHeader: "git-upload-pack"},
+		{ServiceHeaderFlush: true},
+	}
+	if version == 1 {
+		chunks = append(chunks, &gitprotocolio.InfoRefsResponseChunk{ProtocolVersion: 1})
+	}
+
+	caps := append([]string{}, v1UploadPackCapabilities...)
+	refs := []*gitprotocolio.InfoRefsResponseChunk{}
+	for _, ch := range resp {
+		if ch.Response == nil {
+			continue
+		}
+		ss := strings.Split(strings.TrimSpace(string(ch.Response)), " ")
+		if len(ss) < 2 {
+			return nil, status.Errorf(codes.Internal, "cannot parse the ls-refs response: got %d component, want at least 2", len(ss))
+		}
+		refs = append(refs, &gitprotocolio.InfoRefsResponseChunk{ObjectID: ss[0], Ref: ss[1]})
+		for _, attr := range ss[2:] {
+			if strings.HasPrefix(attr, "symref-target:") {
+				caps = append(caps, "symref="+ss[1]+":"+strings.TrimPrefix(attr, "symref-target:"))
+			} else if strings.HasPrefix(attr, "peeled:") {
+				refs = append(refs, &gitprotocolio.InfoRefsResponseChunk{ObjectID: strings.TrimPrefix(attr, "peeled:"), Ref: ss[1] + "^{}"})
+			}
+		}
+	}
+	if len(refs) == 0 {
+		// An empty repository still needs to advertise the capabilities.
+		refs = append(refs, &gitprotocolio.InfoRefsResponseChunk{ObjectID: plumbing.ZeroHash.String(), Ref: "capabilities^{}"})
+	}
+	refs[0].Capabilities = caps
+
+	chunks = append(chunks, refs...)
+	chunks = append(chunks, &gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true})
+	return chunks, nil
+}
+
+func parseV1UploadPackWants(request []byte) ([]plumbing.Hash, error) {
+	hashes := []plumbing.Hash{}
+	req := gitprotocolio.NewProtocolV1UploadPackRequest(bytes.NewReader(request))
+	for req.Scan() {
+		if c := req.Chunk(); c.WantObjectID != "" {
+			hashes = append(hashes, plumbing.NewHash(c.WantObjectID))
+		}
+	}
+	if err := req.Err(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot parse the request: %v", err)
+	}
+	return hashes, nil
+}
@@ -17,6 +17,7 @@ package goblet
 import (
 	"context"
 	"io"
+	"net/url"
 	"strings"
 	"time"
 
@@ -24,20 +25,21 @@ import (
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-const (
-	checkFrequency = 1 * time.Second
-)
-
 type gitProtocolErrorReporter interface {
 	reportError(context.Context, time.Time, error)
 }
 
-func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, repo *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
+// handleV2Command handles a protocol v2 command. clientURL is the repository
+// URL that the client uses, and it's used for the URIs served by Goblet.
+func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, repo *managedRepository, clientURL *url.URL, command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) bool {
 	startTime := time.Now()
+	ctx, span := trace.StartSpan(ctx, "goblet/command/"+command[0].Command)
+	defer span.End()
 	var err error
 	ctx, err = tag.New(ctx, tag.Upsert(CommandTypeKey, command[0].Command))
 	if err != nil {
@@ -53,32 +55,27 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 	}
 	switch command[0].Command {
 	case "ls-refs":
-		ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upstream"))
+		resp, cacheState, lsRefsErr := repo.lsRefs(ctx, command)
+		span.AddAttributes(trace.StringAttribute("goblet.cache_state", cacheState))
+		ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, cacheState))
 		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
-
-		resp, err := repo.lsRefsUpstream(command)
-		if err != nil {
-			reporter.reportError(ctx, startTime, err)
+		if lsRefsErr != nil {
+			reporter.reportError(ctx, startTime, lsRefsErr)
 			return false
 		}
 
-		refs, err := parseLsRefsResponse(resp)
-		if err != nil {
-			reporter.reportError(ctx, startTime, err)
-			return false
-		}
+		writeResp(w, resp)
+		reporter.reportError(ctx, startTime, nil)
+		return true
 
-		if hasUpdate, err := repo.hasAnyUpdate(refs); err != nil {
-			reporter.reportError(ctx, startTime, err)
-			return false
-		} else if hasUpdate {
-			go repo.fetchUpstream()
+	case "bundle-uri":
+		if repo.config.BundleURITTL == 0 {
+			break
 		}
-
-		writeResp(w, resp)
+		writeResp(w, repo.bundleURIList(clientURL))
 		reporter.reportError(ctx, startTime, nil)
 		return true
 
@@ -93,47 +90,36 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 			reporter.reportError(ctx, startTime, err)
 			return false
 		} else if !hasAllWants {
+			span.AddAttributes(trace.StringAttribute("goblet.cache_state", "queried-upstream"))
 			ctx, err = tag.New(ctx, tag.Update(CommandCacheStateKey, "queried-upsteam"))
 			if err != nil {
 				reporter.reportError(ctx, startTime, err)
 				return false
 			}
 
-			fetchStartTime := time.Now()
-			fetchDone := make(chan error, 1)
-			go func() {
-				fetchDone <- repo.fetchUpstream()
-			}()
-			timer := time.NewTimer(checkFrequency)
-		LOOP:
-			for {
-				select {
-				case <-ctx.Done():
-					reporter.reportError(ctx, startTime, ctx.Err())
+			if canSendProgressBeforeFetch(command) {
+				// Keep the client informed while waiting so that
+				// the connection is not closed as idle.
+				relay, err := startFetchProgressRelay(w, repo)
+				if err != nil {
+					reporter.reportError(ctx, startTime, status.Errorf(codes.Canceled, "client IO error"))
+					return false
+				}
+				err = repo.fetchUntilHasAllWants(ctx, wantHashes, wantRefs)
+				if w = relay.finish(err); err != nil {
+					reporter.reportError(ctx, startTime, err)
 					return false
-				case err := <-fetchDone:
-					if hasAllWants, checkErr := repo.hasAllWants(wantHashes, wantRefs); checkErr != nil {
-						reporter.reportError(ctx, startTime, checkErr)
-						return false
-					} else if !hasAllWants {
-						reporter.reportError(ctx, startTime, err)
-						return false
-					}
-					break LOOP
-				case <-timer.C:
-					if hasAllWants, err := repo.hasAllWants(wantHashes, wantRefs); err != nil {
-						reporter.reportError(ctx, startTime, err)
-						return false
-					} else if hasAllWants {
-						break LOOP
-					}
-					timer.Reset(checkFrequency)
 				}
+			} else if err := repo.fetchUntilHasAllWants(ctx, wantHashes, wantRefs); err != nil {
+				reporter.reportError(ctx, startTime, err)
+				return false
 			}
-			stats.Record(ctx, UpstreamFetchWaitingTime.M(int64(time.Now().Sub(fetchStartTime)/time.Millisecond)))
 		}
 
-		if err := repo.serveFetchLocal(command, w); err != nil {
+		_, serveSpan := trace.StartSpan(ctx, "goblet/serve-fetch-local")
+		err = repo.serveFetchLocal(command, w, repo.packfileURIConfig(command)...)
+		endSpan(serveSpan, err)
+		if err != nil {
 			reporter.reportError(ctx, startTime, err)
 			return false
 		}
@@ -144,6 +130,106 @@ func handleV2Command(ctx context.Context, reporter gitProtocolErrorReporter, rep
 	return false
 }
 
+// lsRefs returns the ls-refs response for the command with the cache state
+// that describes how the response is obtained.
+func (r *managedRepository) lsRefs(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, string, error) {
+	if resp, ok := r.getCachedLsRefs(command); ok {
+		return resp, "locally-cached", nil
+	}
+
+	startTime := time.Now()
+	cacheGen := r.lsRefsCacheGeneration()
+	resp, err := r.lsRefsUpstream(ctx, command)
+	if err != nil {
+		if !r.config.ServeStaleLsRefs || !isUpstreamUnavailable(err) {
+			return nil, "queried-upstream", err
+		}
+		staleResp, staleErr := r.lsRefsLocal(command)
+		if staleErr != nil {
+			return nil, "queried-upstream", err
+		}
+		if refs, parseErr := parseLsRefsResponse(staleResp); parseErr != nil || len(refs) == 0 {
+			// Nothing has been cached yet. Report the upstream
+			// error as is.
+			return nil, "queried-upstream", err
+		}
+		return staleResp, "served-stale", nil
+	}
+
+	refs, err := parseLsRefsResponse(resp)
+	if err != nil {
+		return nil, "queried-upstream", err
+	}
+
+	if hasUpdate, err := r.recordUpstreamRefs(refs); err != nil {
+		return nil, "queried-upstream", err
+	} else if hasUpdate {
+		r.requestFetchUpstream()
+	}
+	r.putCachedLsRefs(command, resp, startTime, cacheGen)
+	return resp, "queried-upstream", nil
+}
+
+// fetchUntilHasAllWants fetches from the upstream and waits until the
+// repository has all the wanted objects and refs. The wants are checked every
+// time the refs are updated, so that the caller can proceed as soon as the
+// wants become available even if the fetch is still running.
+func (r *managedRepository) fetchUntilHasAllWants(ctx context.Context, hashes []plumbing.Hash, refs []string) (err error) {
+	fetchStartTime := time.Now()
+	addGauge(UpstreamFetchWaitingClientCount, &upstreamFetchWaitingClientCount, 1)
+	defer addGauge(UpstreamFetchWaitingClientCount, &upstreamFetchWaitingClientCount, -1)
+	ctx, span := trace.StartSpan(ctx, "goblet/wait-upstream-fetch")
+	defer func() {
+		endSpan(span, err)
+	}()
+	updated := r.refsUpdateNotifier()
+	f := r.requestFetchUpstream()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-f.done:
+			// The fetch runs in its own trace as it's shared by
+			// multiple requests.
+			span.AddLink(trace.Link{
+				TraceID: f.spanContext.TraceID,
+				SpanID:  f.spanContext.SpanID,
+				Type:    trace.LinkTypeChild,
+			})
+			if found, upToDate, err := r.checkWants(hashes, refs); err != nil {
+				return err
+			} else if !found {
+				if f.err != nil {
+					return f.err
+				}
+				return status.Error(codes.NotFound, "the upstream doesn't have the wanted objects")
+			} else if !upToDate {
+				// The upstream advertised the wanted refs
+				// again after the fetch started.
+				f = r.requestFetchUpstream()
+				continue
+			}
+		case <-updated:
+			updated = r.refsUpdateNotifier()
+			if hasAllWants, err := r.hasAllWants(hashes, refs); err != nil {
+				return err
+			} else if !hasAllWants {
+				continue
+			}
+		}
+		stats.Record(ctx, UpstreamFetchWaitingTime.M(int64(time.Now().Sub(fetchStartTime)/time.Millisecond)))
+		return nil
+	}
+}
+
+func isUpstreamUnavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
 func parseLsRefsResponse(chunks []*gitprotocolio.ProtocolV2ResponseChunk) (map[string]plumbing.Hash, error) {
 	m := map[string]plumbing.Hash{}
 	for _, ch := range chunks {
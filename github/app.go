@@ -0,0 +1,282 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package github provides the hooks to mirror GitHub repositories.
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/goblet"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultAPIBaseURL = "https://api.github.com"
+
+	// The maximum lifetime of a GitHub App JWT is 10 minutes.
+	jwtLifetime = 9 * time.Minute
+
+	// Refresh the installation tokens a bit earlier than the expiry so
+	// that a long git-fetch doesn't use an expired token.
+	tokenExpiryDelta = 5 * time.Minute
+
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// AppConfig is a configuration of a GitHub App.
+type AppConfig struct {
+	// AppID is the GitHub App ID.
+	AppID int64
+
+	// PrivateKey is a PEM-encoded private key of the GitHub App.
+	PrivateKey []byte
+
+	// APIBaseURL is a base URL of the GitHub REST API. Defaults to
+	// https://api.github.com. For GitHub Enterprise Server, this is
+	// https://HOSTNAME/api/v3.
+	APIBaseURL string
+
+	// HTTPClient is used to call the GitHub API. Defaults to a client with
+	// a 30-second timeout.
+	HTTPClient *http.Client
+}
+
+// AppCredentialProvider is a goblet.CredentialProvider that authenticates as
+// the GitHub App installation of the upstream repository owner.
+type AppCredentialProvider struct {
+	appID      int64
+	key        *rsa.PrivateKey
+	apiBaseURL string
+	client     *http.Client
+
+	mu sync.Mutex
+	// Installation IDs keyed by the lower-cased owner names.
+	installations map[string]int64
+	tokenSources  map[int64]oauth2.TokenSource
+}
+
+// NewAppCredentialProvider returns an AppCredentialProvider for the GitHub
+// App.
+func NewAppCredentialProvider(config *AppConfig) (*AppCredentialProvider, error) {
+	key, err := parsePrivateKey(config.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	p := &AppCredentialProvider{
+		appID:         config.AppID,
+		key:           key,
+		apiBaseURL:    strings.TrimSuffix(config.APIBaseURL, "/"),
+		client:        config.HTTPClient,
+		installations: map[string]int64{},
+		tokenSources:  map[int64]oauth2.TokenSource{},
+	}
+	if p.apiBaseURL == "" {
+		p.apiBaseURL = defaultAPIBaseURL
+	}
+	if p.client == nil {
+		p.client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	return p, nil
+}
+
+// Credential returns the installation access token for the owner of the
+// canonical upstream URL (https://github.com/OWNER/REPO) in the form that Git
+// uses for GitHub Apps (x-access-token:TOKEN).
+func (p *AppCredentialProvider) Credential(u *url.URL) (*goblet.Credential, error) {
+	owner := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	if owner == "" {
+		return nil, fmt.Errorf("cannot find the repository owner in %s", u.String())
+	}
+	t, err := p.TokenSource(owner).Token()
+	if err != nil {
+		return nil, err
+	}
+	return &goblet.Credential{Username: "x-access-token", Password: t.AccessToken}, nil
+}
+
+// TokenSource returns an oauth2.TokenSource of the installation access tokens
+// for the owner (a user or an organization). The tokens are cached until
+// shortly before they expire.
+func (p *AppCredentialProvider) TokenSource(owner string) oauth2.TokenSource {
+	return oauth2.TokenSource(tokenSourceFunc(func() (*oauth2.Token, error) {
+		id, err := p.installationID(owner)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		ts, ok := p.tokenSources[id]
+		if !ok {
+			ts = oauth2.ReuseTokenSource(nil, tokenSourceFunc(func() (*oauth2.Token, error) {
+				return p.newInstallationToken(id)
+			}))
+			p.tokenSources[id] = ts
+		}
+		p.mu.Unlock()
+		return ts.Token()
+	}))
+}
+
+func (p *AppCredentialProvider) installationID(owner string) (int64, error) {
+	key := strings.ToLower(owner)
+	p.mu.Lock()
+	id, ok := p.installations[key]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var resp struct {
+		ID int64 `json:"id"`
+	}
+	// Organizations and users have different endpoints.
+	err := p.callAPI("GET", "/orgs/"+url.PathEscape(owner)+"/installation", &resp)
+	if e, ok := err.(*apiError); ok && e.statusCode == http.StatusNotFound {
+		err = p.callAPI("GET", "/users/"+url.PathEscape(owner)+"/installation", &resp)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot find the GitHub App installation for %s: %v", owner, err)
+	}
+
+	p.mu.Lock()
+	p.installations[key] = resp.ID
+	p.mu.Unlock()
+	return resp.ID, nil
+}
+
+func (p *AppCredentialProvider) newInstallationToken(id int64) (*oauth2.Token, error) {
+	var resp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := p.callAPI("POST", fmt.Sprintf("/app/installations/%d/access_tokens", id), &resp); err != nil {
+		if e, ok := err.(*apiError); ok && e.statusCode == http.StatusNotFound {
+			// The app is uninstalled. Find the installation again
+			// next time.
+			p.forgetInstallation(id)
+		}
+		return nil, fmt.Errorf("cannot create an installation access token: %v", err)
+	}
+	return &oauth2.Token{
+		AccessToken: resp.Token,
+		Expiry:      resp.ExpiresAt.Add(-tokenExpiryDelta),
+	}, nil
+}
+
+func (p *AppCredentialProvider) forgetInstallation(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for owner, ownerID := range p.installations {
+		if ownerID == id {
+			delete(p.installations, owner)
+		}
+	}
+	delete(p.tokenSources, id)
+}
+
+type apiError struct {
+	statusCode int
+	message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("GitHub API returned %d: %s", e.statusCode, e.message)
+}
+
+func (p *AppCredentialProvider) callAPI(method, path string, v interface{}) error {
+	jwt, err := p.signJWT(time.Now())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, p.apiBaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		return &apiError{statusCode: resp.StatusCode, message: string(bs)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// signJWT returns a JWT that authenticates as the GitHub App.
+func (p *AppCredentialProvider) signJWT(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow the clock drift.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": p.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("cannot sign the GitHub App JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func parsePrivateKey(bs []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(bs)
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode the GitHub App private key as PEM")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the GitHub App private key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the GitHub App private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+type tokenSourceFunc func() (*oauth2.Token, error)
+
+func (f tokenSourceFunc) Token() (*oauth2.Token, error) {
+	return f()
+}
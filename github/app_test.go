@@ -0,0 +1,280 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAppID = 12345
+
+// fakeGitHubAPI serves the GitHub App endpoints used by AppCredentialProvider.
+type fakeGitHubAPI struct {
+	t   *testing.T
+	key *rsa.PublicKey
+
+	mu sync.Mutex
+	// orgs and users map the owner names to the installation IDs.
+	orgs  map[string]int64
+	users map[string]int64
+	// uninstalled has the installation IDs whose tokens cannot be created.
+	uninstalled map[int64]bool
+	// tokenLifetime is the lifetime of the created tokens.
+	tokenLifetime time.Duration
+	requests      []string
+	tokenCount    int
+}
+
+func (f *fakeGitHubAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if err := f.verifyJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+		f.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var id int64
+	var ok bool
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/orgs/"):
+		id, ok = f.orgs[strings.Split(r.URL.Path, "/")[2]]
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/users/"):
+		id, ok = f.users[strings.Split(r.URL.Path, "/")[2]]
+	case r.Method == "POST":
+		if _, err := fmt.Sscanf(r.URL.Path, "/app/installations/%d/access_tokens", &id); err != nil || f.uninstalled[id] {
+			break
+		}
+		f.tokenCount++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":      fmt.Sprintf("token-%d-%d", id, f.tokenCount),
+			"expires_at": time.Now().Add(f.tokenLifetime),
+		})
+		return
+	}
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id})
+}
+
+func (f *fakeGitHubAPI) verifyJWT(jwt string) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("got a JWT with %d parts, want 3", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("invalid JWT signature: %v", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("got alg %q, want RS256", header.Alg)
+	}
+	var claims struct {
+		IAT int64 `json:"iat"`
+		EXP int64 `json:"exp"`
+		ISS int64 `json:"iss"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	if claims.ISS != testAppID {
+		return fmt.Errorf("got iss %d, want %d", claims.ISS, testAppID)
+	}
+	if claims.IAT > now {
+		return fmt.Errorf("got iat %d in the future", claims.IAT)
+	}
+	if claims.EXP <= now || claims.EXP-claims.IAT > int64((10*time.Minute)/time.Second) {
+		return fmt.Errorf("got iat %d and exp %d, want a lifetime up to 10 minutes", claims.IAT, claims.EXP)
+	}
+	return nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func (f *fakeGitHubAPI) popRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := f.requests
+	f.requests = nil
+	return ret
+}
+
+func newTestAppCredentialProvider(t *testing.T) (*AppCredentialProvider, *fakeGitHubAPI, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeGitHubAPI{
+		t:             t,
+		key:           &key.PublicKey,
+		orgs:          map[string]int64{},
+		users:         map[string]int64{},
+		uninstalled:   map[int64]bool{},
+		tokenLifetime: time.Hour,
+	}
+	s := httptest.NewServer(f)
+	p, err := NewAppCredentialProvider(&AppConfig{
+		AppID:      testAppID,
+		PrivateKey: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		APIBaseURL: s.URL + "/",
+	})
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return p, f, s.Close
+}
+
+func credentialPassword(t *testing.T, p *AppCredentialProvider, repo string) string {
+	c, err := p.Credential(&url.URL{Scheme: "https", Host: "github.com", Path: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Username != "x-access-token" {
+		t.Errorf("got username %q, want x-access-token", c.Username)
+	}
+	return c.Password
+}
+
+func equalRequests(got, want []string) bool {
+	return strings.Join(got, "\n") == strings.Join(want, "\n")
+}
+
+func TestAppCredentialProvider_Organization(t *testing.T) {
+	p, f, cleanup := newTestAppCredentialProvider(t)
+	defer cleanup()
+	f.orgs["google"] = 1
+
+	if got := credentialPassword(t, p, "/google/goblet"); got != "token-1-1" {
+		t.Errorf("got %q, want token-1-1", got)
+	}
+	want := []string{"GET /orgs/google/installation", "POST /app/installations/1/access_tokens"}
+	if got := f.popRequests(); !equalRequests(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+func TestAppCredentialProvider_UserFallback(t *testing.T) {
+	p, f, cleanup := newTestAppCredentialProvider(t)
+	defer cleanup()
+	f.users["octocat"] = 2
+
+	if got := credentialPassword(t, p, "/octocat/hello-world"); got != "token-2-1" {
+		t.Errorf("got %q, want token-2-1", got)
+	}
+	want := []string{"GET /orgs/octocat/installation", "GET /users/octocat/installation", "POST /app/installations/2/access_tokens"}
+	if got := f.popRequests(); !equalRequests(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+
+	if _, err := p.Credential(&url.URL{Scheme: "https", Host: "github.com", Path: "/unknown/repo"}); err == nil {
+		t.Error("got a credential for an owner without the installation")
+	}
+}
+
+func TestAppCredentialProvider_TokenReuse(t *testing.T) {
+	p, f, cleanup := newTestAppCredentialProvider(t)
+	defer cleanup()
+	f.orgs["google"] = 1
+
+	// The token is reused until tokenExpiryDelta before the expiry.
+	f.tokenLifetime = tokenExpiryDelta + time.Hour
+	first := credentialPassword(t, p, "/google/goblet")
+	if got := credentialPassword(t, p, "/google/gitprotocolio"); got != first {
+		t.Errorf("got %q, want the reused token %q", got, first)
+	}
+	want := []string{"GET /orgs/google/installation", "POST /app/installations/1/access_tokens"}
+	if got := f.popRequests(); !equalRequests(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+func TestAppCredentialProvider_TokenRefresh(t *testing.T) {
+	p, f, cleanup := newTestAppCredentialProvider(t)
+	defer cleanup()
+	f.orgs["google"] = 1
+
+	// A token that expires within tokenExpiryDelta is not reused.
+	f.tokenLifetime = tokenExpiryDelta - time.Minute
+	first := credentialPassword(t, p, "/google/goblet")
+	if got := credentialPassword(t, p, "/google/goblet"); got == first {
+		t.Errorf("got the token %q again, want a new token", got)
+	}
+	want := []string{"GET /orgs/google/installation", "POST /app/installations/1/access_tokens", "POST /app/installations/1/access_tokens"}
+	if got := f.popRequests(); !equalRequests(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
+
+func TestAppCredentialProvider_Reinstalled(t *testing.T) {
+	p, f, cleanup := newTestAppCredentialProvider(t)
+	defer cleanup()
+	f.orgs["google"] = 1
+	f.tokenLifetime = tokenExpiryDelta - time.Minute
+	credentialPassword(t, p, "/google/goblet")
+	f.popRequests()
+
+	// The app is uninstalled and installed again with a new ID.
+	f.mu.Lock()
+	f.uninstalled[1] = true
+	f.orgs["google"] = 3
+	f.mu.Unlock()
+	if _, err := p.Credential(&url.URL{Scheme: "https", Host: "github.com", Path: "/google/goblet"}); err == nil {
+		t.Error("got a credential for the uninstalled app")
+	}
+	if got := credentialPassword(t, p, "/google/goblet"); got != "token-3-2" {
+		t.Errorf("got %q, want token-3-2", got)
+	}
+	want := []string{"POST /app/installations/1/access_tokens", "GET /orgs/google/installation", "POST /app/installations/3/access_tokens"}
+	if got := f.popRequests(); !equalRequests(got, want) {
+		t.Errorf("got requests %v, want %v", got, want)
+	}
+}
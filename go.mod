@@ -6,10 +6,11 @@ require (
 	cloud.google.com/go v0.86.0
 	cloud.google.com/go/logging v1.4.2
 	cloud.google.com/go/storage v1.16.0
+	contrib.go.opencensus.io/exporter/prometheus v0.4.1
 	contrib.go.opencensus.io/exporter/stackdriver v0.13.1
 	github.com/Microsoft/go-winio v0.5.0 // indirect
 	github.com/ProtonMail/go-crypto v0.0.0-20210705153151-cc34b1f6908b // indirect
-	github.com/aws/aws-sdk-go v1.30.7 // indirect
+	github.com/aws/aws-sdk-go v1.30.7
 	github.com/go-git/go-git/v5 v5.4.2
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/google/gitprotocolio v0.0.0-20210704173409-b5a56823ae52
@@ -25,4 +26,5 @@ require (
 	google.golang.org/api v0.50.0
 	google.golang.org/genproto v0.0.0-20210708141623-e76da96a951f
 	google.golang.org/grpc v1.39.0
+	gopkg.in/yaml.v2 v2.4.0
 )
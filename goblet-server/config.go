@@ -0,0 +1,546 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/goblet"
+	googlehook "github.com/google/goblet/google"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+)
+
+// serverConfig is the configuration of goblet-server. It's read from the
+// -config file, which is JSON or YAML (.yaml or .yml). The fields that are not
+// in the file are taken from the flags.
+type serverConfig struct {
+	// ListenAddress is the host or IP address to listen on. Empty means
+	// all interfaces.
+	ListenAddress string    `json:"listen_address"`
+	Port          int       `json:"port"`
+	TLS           tlsConfig `json:"tls"`
+	CacheRoot     string    `json:"cache_root"`
+	Authorizer    string    `json:"authorizer"`
+
+	// UpstreamHostRules and UpstreamCredentials can be reloaded with
+	// SIGHUP.
+	UpstreamHostRules   []*goblet.UpstreamHostRule  `json:"upstream_host_rules"`
+	UpstreamCredentials []*upstreamCredentialConfig `json:"upstream_credentials"`
+
+	Admin       adminConfig       `json:"admin"`
+	Backup      backupConfig      `json:"backup"`
+	Maintenance maintenanceConfig `json:"maintenance"`
+	Limits      limitsConfig      `json:"limits"`
+	Push        pushConfig        `json:"push"`
+	Offload     offloadConfig     `json:"offload"`
+	Logging     loggingConfig     `json:"logging"`
+	Metrics     metricsConfig     `json:"metrics"`
+	Tracing     tracingConfig     `json:"tracing"`
+}
+
+type tlsConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+type adminConfig struct {
+	ListenAddress string `json:"listen_address"`
+	Port          int    `json:"port"`
+	TokenFile     string `json:"token_file"`
+}
+
+type backupConfig struct {
+	// Type is one of "gcs", "s3", and "local".
+	Type         string `json:"type"`
+	BucketName   string `json:"bucket_name"`
+	LocalDir     string `json:"local_dir"`
+	ManifestName string `json:"manifest_name"`
+
+	// S3Endpoint and S3ForcePathStyle are used for S3-compatible storages.
+	S3Endpoint       string `json:"s3_endpoint"`
+	S3Region         string `json:"s3_region"`
+	S3ForcePathStyle bool   `json:"s3_force_path_style"`
+
+	// RestoreConcurrency is the number of the repositories restored in
+	// parallel at startup.
+	RestoreConcurrency int `json:"restore_concurrency"`
+
+	// LazyRestore restores the repositories when they're first requested
+	// instead of at startup.
+	LazyRestore bool `json:"lazy_restore"`
+}
+
+type maintenanceConfig struct {
+	Interval duration `json:"interval"`
+	Tasks    []string `json:"tasks"`
+}
+
+type limitsConfig struct {
+	CacheDiskQuotaBytes int64    `json:"cache_disk_quota_bytes"`
+	LsRefsCacheTTL      duration `json:"ls_refs_cache_ttl"`
+	ServeStaleLsRefs    bool     `json:"serve_stale_ls_refs"`
+}
+
+type pushConfig struct {
+	Forward                  bool `json:"forward"`
+	ForwardClientCredentials bool `json:"forward_client_credentials"`
+}
+
+// offloadConfig is the settings to move the transfers out of upload-pack.
+type offloadConfig struct {
+	BundleURITTL           duration `json:"bundle_uri_ttl"`
+	PackfileURIMinBlobSize int64    `json:"packfile_uri_min_blob_size"`
+	PackfileURIBaseURL     string   `json:"packfile_uri_base_url"`
+}
+
+type loggingConfig struct {
+	StackdriverProject      string `json:"stackdriver_project"`
+	StackdriverLoggingLogID string `json:"stackdriver_logging_log_id"`
+}
+
+type metricsConfig struct {
+	Prometheus    bool   `json:"prometheus"`
+	ListenAddress string `json:"listen_address"`
+	Port          int    `json:"port"`
+}
+
+type tracingConfig struct {
+	Exporter            string  `json:"exporter"`
+	SamplingProbability float64 `json:"sampling_probability"`
+}
+
+// duration is a time.Duration written as a string like "10m" in JSON.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"10m\": %v", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadServerConfig returns the configuration from the flags and the -config
+// file.
+func loadServerConfig() (*serverConfig, error) {
+	c, err := serverConfigFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		bs, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if ext := filepath.Ext(*configFile); ext == ".yaml" || ext == ".yml" {
+			if bs, err = yamlToJSON(bs); err != nil {
+				return nil, fmt.Errorf("cannot parse %s: %v", *configFile, err)
+			}
+		}
+		dec := json.NewDecoder(bytes.NewReader(bs))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %v", *configFile, err)
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return c, nil
+}
+
+func serverConfigFromFlags() (*serverConfig, error) {
+	c := &serverConfig{
+		ListenAddress: *listenAddress,
+		Port:          *port,
+		CacheRoot:     *cacheRoot,
+		Authorizer:    "google",
+		Admin: adminConfig{
+			ListenAddress: *adminListenAddress,
+			Port:          *adminPort,
+			TokenFile:     *adminTokenFile,
+		},
+		Backup: backupConfig{
+			Type:         *backupType,
+			BucketName:   *backupBucketName,
+			LocalDir:     *backupLocalDir,
+			ManifestName: *backupManifestName,
+			S3Endpoint:   *backupS3Endpoint,
+			S3Region:     *backupS3Region,
+
+			RestoreConcurrency: *backupRestoreConcurrency,
+			LazyRestore:        *backupLazyRestore,
+		},
+		Maintenance: maintenanceConfig{
+			Interval: duration(*maintenanceInterval),
+		},
+		Limits: limitsConfig{
+			CacheDiskQuotaBytes: *cacheDiskQuota,
+			LsRefsCacheTTL:      duration(*lsRefsCacheTTL),
+			ServeStaleLsRefs:    *serveStaleLsRefs,
+		},
+		Push: pushConfig{
+			Forward:                  *forwardPushes,
+			ForwardClientCredentials: *forwardPushClientCredentials,
+		},
+		Offload: offloadConfig{
+			BundleURITTL:           duration(*bundleURITTL),
+			PackfileURIMinBlobSize: *packfileURIMinBlobSize,
+			PackfileURIBaseURL:     *packfileURIBaseURL,
+		},
+		Logging: loggingConfig{
+			StackdriverProject:      *stackdriverProject,
+			StackdriverLoggingLogID: *stackdriverLoggingLogID,
+		},
+		Metrics: metricsConfig{
+			Prometheus:    *prometheusMetrics,
+			ListenAddress: *metricsListenAddress,
+			Port:          *metricsPort,
+		},
+		Tracing: tracingConfig{
+			Exporter:            *traceExporter,
+			SamplingProbability: *traceSamplingProbability,
+		},
+	}
+	if *maintenanceTasks != "" {
+		for _, name := range strings.Split(*maintenanceTasks, ",") {
+			c.Maintenance.Tasks = append(c.Maintenance.Tasks, strings.TrimSpace(name))
+		}
+	}
+	if *upstreamHostRules != "" {
+		if err := readJSONFile(*upstreamHostRules, &c.UpstreamHostRules); err != nil {
+			return nil, err
+		}
+	}
+	if *upstreamCredentials != "" {
+		if err := readJSONFile(*upstreamCredentials, &c.UpstreamCredentials); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// yamlToJSON converts YAML to JSON so that the YAML config file is decoded in
+// the same way as JSON.
+func yamlToJSON(bs []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(bs, &v); err != nil {
+		return nil, err
+	}
+	v, err := jsonCompatible(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// jsonCompatible replaces map[interface{}]interface{} produced by the YAML
+// decoder with map[string]interface{}.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			s, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			var err error
+			if m[s], err = jsonCompatible(e); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			var err error
+			if v[i], err = jsonCompatible(e); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+func readJSONFile(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *serverConfig) validate() error {
+	if c.CacheRoot == "" {
+		return fmt.Errorf("cache_root is required")
+	}
+	if err := validateListenAddress(c.ListenAddress); err != nil {
+		return fmt.Errorf("listen_address: %v", err)
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", c.Port)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls needs both cert_file and key_file")
+	}
+	switch c.Authorizer {
+	case "google", "none":
+	default:
+		return fmt.Errorf("unknown authorizer %q (google or none)", c.Authorizer)
+	}
+	if _, err := c.urlCanonicalizer(); err != nil {
+		return fmt.Errorf("upstream_host_rules: %v", err)
+	}
+	if err := validateListenAddress(c.Admin.ListenAddress); err != nil {
+		return fmt.Errorf("admin.listen_address: %v", err)
+	}
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		return fmt.Errorf("admin.port %d is out of range", c.Admin.Port)
+	}
+	if c.Admin.Port != 0 && c.Admin.TokenFile == "" {
+		return fmt.Errorf("admin.token_file is required for the admin API")
+	}
+	if err := c.Backup.validate(); err != nil {
+		return fmt.Errorf("backup: %v", err)
+	}
+	if c.Maintenance.Interval < 0 {
+		return fmt.Errorf("maintenance.interval should not be negative")
+	}
+	if _, err := c.maintenanceTasks(); err != nil {
+		return fmt.Errorf("maintenance.tasks: %v", err)
+	}
+	if c.Limits.CacheDiskQuotaBytes < 0 {
+		return fmt.Errorf("limits.cache_disk_quota_bytes should not be negative")
+	}
+	if c.Limits.LsRefsCacheTTL < 0 {
+		return fmt.Errorf("limits.ls_refs_cache_ttl should not be negative")
+	}
+	if c.Offload.BundleURITTL < 0 {
+		return fmt.Errorf("offload.bundle_uri_ttl should not be negative")
+	}
+	if c.Offload.PackfileURIMinBlobSize < 0 {
+		return fmt.Errorf("offload.packfile_uri_min_blob_size should not be negative")
+	}
+	if c.Offload.PackfileURIMinBlobSize != 0 {
+		if u, err := url.Parse(c.Offload.PackfileURIBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("offload.packfile_uri_min_blob_size needs an HTTP(S) URL in offload.packfile_uri_base_url")
+		}
+	}
+	if err := validateListenAddress(c.Metrics.ListenAddress); err != nil {
+		return fmt.Errorf("metrics.listen_address: %v", err)
+	}
+	if c.Metrics.Port < 0 || c.Metrics.Port > 65535 {
+		return fmt.Errorf("metrics.port %d is out of range", c.Metrics.Port)
+	}
+	if c.Metrics.Prometheus && c.Metrics.Port == 0 {
+		return fmt.Errorf("metrics.prometheus needs metrics.port")
+	}
+	if c.Logging.StackdriverLoggingLogID != "" && c.Logging.StackdriverProject == "" {
+		return fmt.Errorf("logging.stackdriver_logging_log_id needs logging.stackdriver_project")
+	}
+	switch c.Tracing.Exporter {
+	case "", "none", "stdout":
+	case "stackdriver":
+		if c.Logging.StackdriverProject == "" {
+			return fmt.Errorf("tracing.exporter stackdriver needs logging.stackdriver_project")
+		}
+	default:
+		return fmt.Errorf("unknown tracing.exporter %q (none, stdout, or stackdriver)", c.Tracing.Exporter)
+	}
+	if c.Tracing.SamplingProbability < 0 || c.Tracing.SamplingProbability > 1 {
+		return fmt.Errorf("tracing.sampling_probability should be in [0, 1]")
+	}
+	return nil
+}
+
+// validateListenAddress checks the host part of a listen address.
+func validateListenAddress(host string) error {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return fmt.Errorf("%q should not have a port", host)
+	}
+	return nil
+}
+
+func (c *backupConfig) validate() error {
+	switch c.Type {
+	case "gcs", "s3", "local":
+	default:
+		return fmt.Errorf("unknown type %q (gcs, s3, or local)", c.Type)
+	}
+	if !c.enabled() {
+		return nil
+	}
+	if c.RestoreConcurrency < 1 {
+		return fmt.Errorf("restore_concurrency should be positive")
+	}
+	return nil
+}
+
+// enabled returns true if both the storage and the manifest are configured.
+// Otherwise the backup is disabled.
+func (c *backupConfig) enabled() bool {
+	if c.ManifestName == "" {
+		return false
+	}
+	if c.Type == "local" {
+		return c.LocalDir != ""
+	}
+	return c.BucketName != ""
+}
+
+func (c *serverConfig) urlCanonicalizer() (func(*url.URL) (*url.URL, error), error) {
+	if len(c.UpstreamHostRules) == 0 {
+		return googlehook.CanonicalizeURL, nil
+	}
+	return goblet.NewURLCanonicalizer(c.UpstreamHostRules)
+}
+
+func (c *serverConfig) credentialProvider(ts oauth2.TokenSource) (goblet.CredentialProvider, error) {
+	if len(c.UpstreamCredentials) == 0 {
+		return goblet.NewTokenSourceCredentialProvider(ts), nil
+	}
+	return newCredentialProvider(c.UpstreamCredentials, ts)
+}
+
+func (c *serverConfig) maintenanceTasks() ([]goblet.MaintenanceTask, error) {
+	var tasks []goblet.MaintenanceTask
+	for _, name := range c.Maintenance.Tasks {
+		task, err := goblet.ParseMaintenanceTask(name)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+// reloadableConfig holds the parts of the configuration that can be changed
+// while the server is running. goblet.ServerConfig refers to them through
+// this.
+type reloadableConfig struct {
+	ts            oauth2.TokenSource
+	canonicalizer atomic.Value // urlCanonicalizerHolder
+	credentials   atomic.Value // credentialProviderHolder
+}
+
+type urlCanonicalizerHolder struct {
+	f func(*url.URL) (*url.URL, error)
+}
+
+type credentialProviderHolder struct {
+	p goblet.CredentialProvider
+}
+
+func newReloadableConfig(c *serverConfig, ts oauth2.TokenSource) (*reloadableConfig, error) {
+	r := &reloadableConfig{ts: ts}
+	if err := r.update(c); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *reloadableConfig) update(c *serverConfig) error {
+	canonicalizer, err := c.urlCanonicalizer()
+	if err != nil {
+		return fmt.Errorf("cannot load the upstream host rules: %v", err)
+	}
+	credentials, err := c.credentialProvider(r.ts)
+	if err != nil {
+		return fmt.Errorf("cannot load the upstream credentials: %v", err)
+	}
+	r.canonicalizer.Store(urlCanonicalizerHolder{canonicalizer})
+	r.credentials.Store(credentialProviderHolder{credentials})
+	return nil
+}
+
+func (r *reloadableConfig) canonicalizeURL(u *url.URL) (*url.URL, error) {
+	return r.canonicalizer.Load().(urlCanonicalizerHolder).f(u)
+}
+
+func (r *reloadableConfig) Credential(u *url.URL) (*goblet.Credential, error) {
+	return r.credentials.Load().(credentialProviderHolder).p.Credential(u)
+}
+
+// reloadableFields are the JSON names of the serverConfig fields that
+// reloadServerConfig applies.
+var reloadableFields = map[string]bool{
+	"upstream_host_rules":  true,
+	"upstream_credentials": true,
+}
+
+// reloadServerConfig reads the configuration again and applies it.
+func reloadServerConfig(current *serverConfig, r *reloadableConfig) (*serverConfig, error) {
+	c, err := loadServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return applyServerConfig(current, c, r)
+}
+
+// applyServerConfig applies the reloadable parts of the new configuration. If
+// the other parts are changed, nothing is applied.
+func applyServerConfig(current, c *serverConfig, r *reloadableConfig) (*serverConfig, error) {
+	if changed := nonReloadableChanges(current, c); len(changed) != 0 {
+		return nil, fmt.Errorf("%s cannot be changed without a restart", strings.Join(changed, ", "))
+	}
+	if err := r.update(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// nonReloadableChanges returns the JSON names of the fields that are
+// different between the configurations except reloadableFields.
+func nonReloadableChanges(a, b *serverConfig) []string {
+	changed := []string{}
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		name := va.Type().Field(i).Tag.Get("json")
+		if reloadableFields[name] {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,294 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+)
+
+func validServerConfig() *serverConfig {
+	return &serverConfig{
+		Port:       8080,
+		CacheRoot:  "/var/cache/goblet",
+		Authorizer: "none",
+		Backup: backupConfig{
+			Type:               "gcs",
+			RestoreConcurrency: 4,
+		},
+	}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*serverConfig)
+		// wantErr is a substring of the error. Empty means valid.
+		wantErr string
+	}{
+		{"valid", func(c *serverConfig) {}, ""},
+		{"listen address", func(c *serverConfig) { c.ListenAddress = "127.0.0.1" }, ""},
+		{"IPv6 listen address", func(c *serverConfig) { c.ListenAddress = "::1" }, ""},
+		{"listen address with port", func(c *serverConfig) { c.ListenAddress = "127.0.0.1:8080" }, "listen_address"},
+		{"no cache root", func(c *serverConfig) { c.CacheRoot = "" }, "cache_root"},
+		{"zero port", func(c *serverConfig) { c.Port = 0 }, "port 0"},
+		{"large port", func(c *serverConfig) { c.Port = 65536 }, "port 65536"},
+		{"cert only", func(c *serverConfig) { c.TLS.CertFile = "tls.crt" }, "tls"},
+		{"unknown authorizer", func(c *serverConfig) { c.Authorizer = "basic" }, "authorizer"},
+		{"invalid host rule", func(c *serverConfig) {
+			c.UpstreamHostRules = []*goblet.UpstreamHostRule{{Host: ""}}
+		}, "upstream_host_rules"},
+		{"admin without token", func(c *serverConfig) { c.Admin.Port = 8081 }, "admin.token_file"},
+		{"admin", func(c *serverConfig) {
+			c.Admin.Port = 8081
+			c.Admin.TokenFile = "token"
+			c.Admin.ListenAddress = "localhost"
+		}, ""},
+		{"admin listen address with port", func(c *serverConfig) { c.Admin.ListenAddress = "localhost:8081" }, "admin.listen_address"},
+		{"unknown backup type", func(c *serverConfig) { c.Backup.Type = "ftp" }, "backup"},
+		{"backup bucket only", func(c *serverConfig) { c.Backup.BucketName = "bucket" }, ""},
+		{"backup manifest only", func(c *serverConfig) { c.Backup.ManifestName = "prod" }, ""},
+		{"backup", func(c *serverConfig) {
+			c.Backup.BucketName = "bucket"
+			c.Backup.ManifestName = "prod"
+		}, ""},
+		{"backup without concurrency", func(c *serverConfig) {
+			c.Backup.Type = "local"
+			c.Backup.LocalDir = "/backup"
+			c.Backup.ManifestName = "prod"
+			c.Backup.RestoreConcurrency = 0
+		}, "restore_concurrency"},
+		{"negative maintenance interval", func(c *serverConfig) { c.Maintenance.Interval = -1 }, "maintenance.interval"},
+		{"unknown maintenance task", func(c *serverConfig) { c.Maintenance.Tasks = []string{"fsck"} }, "maintenance.tasks"},
+		{"negative quota", func(c *serverConfig) { c.Limits.CacheDiskQuotaBytes = -1 }, "cache_disk_quota_bytes"},
+		{"negative ls-refs TTL", func(c *serverConfig) { c.Limits.LsRefsCacheTTL = -1 }, "ls_refs_cache_ttl"},
+		{"negative bundle-uri TTL", func(c *serverConfig) { c.Offload.BundleURITTL = -1 }, "bundle_uri_ttl"},
+		{"packfile-uris without URL", func(c *serverConfig) { c.Offload.PackfileURIMinBlobSize = 1 }, "packfile_uri_base_url"},
+		{"packfile-uris", func(c *serverConfig) {
+			c.Offload.PackfileURIMinBlobSize = 1
+			c.Offload.PackfileURIBaseURL = "https://goblet.example.com"
+		}, ""},
+		{"prometheus without port", func(c *serverConfig) { c.Metrics.Prometheus = true }, "metrics.port"},
+		{"prometheus", func(c *serverConfig) {
+			c.Metrics.Prometheus = true
+			c.Metrics.ListenAddress = "127.0.0.1"
+			c.Metrics.Port = 9090
+		}, ""},
+		{"metrics port out of range", func(c *serverConfig) { c.Metrics.Port = 65536 }, "metrics.port"},
+		{"metrics listen address with port", func(c *serverConfig) { c.Metrics.ListenAddress = "localhost:9090" }, "metrics.listen_address"},
+		{"log ID without project", func(c *serverConfig) { c.Logging.StackdriverLoggingLogID = "goblet" }, "stackdriver_project"},
+		{"stackdriver tracing without project", func(c *serverConfig) { c.Tracing.Exporter = "stackdriver" }, "stackdriver_project"},
+		{"unknown trace exporter", func(c *serverConfig) { c.Tracing.Exporter = "jaeger" }, "tracing.exporter"},
+		{"sampling probability", func(c *serverConfig) { c.Tracing.SamplingProbability = 1.5 }, "sampling_probability"},
+	}
+	for _, tc := range tests {
+		c := validServerConfig()
+		tc.modify(c)
+		err := c.validate()
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%s: got %v, want no error", tc.name, err)
+		case tc.wantErr != "" && err == nil:
+			t.Errorf("%s: got no error, want an error about %s", tc.name, tc.wantErr)
+		case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+			t.Errorf("%s: got %v, want an error about %s", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestBackupConfigEnabled(t *testing.T) {
+	tests := []struct {
+		name string
+		c    backupConfig
+		want bool
+	}{
+		{"gcs", backupConfig{Type: "gcs", BucketName: "bucket", ManifestName: "prod"}, true},
+		{"s3 bucket only", backupConfig{Type: "s3", BucketName: "bucket"}, false},
+		{"gcs manifest only", backupConfig{Type: "gcs", ManifestName: "prod"}, false},
+		{"local", backupConfig{Type: "local", LocalDir: "/backup", ManifestName: "prod"}, true},
+		{"local with bucket", backupConfig{Type: "local", BucketName: "bucket", ManifestName: "prod"}, false},
+	}
+	for _, tc := range tests {
+		if got := tc.c.enabled(); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		// wantErr is a substring of the error.
+		wantErr string
+	}{
+		{"scalars", "port: 8080\nauthorizer: none\nmetrics: {prometheus: true}\n", `{"authorizer":"none","metrics":{"prometheus":true},"port":8080}`, ""},
+		{"list of maps", "upstream_host_rules:\n  - host: github.com\n    strip_path_prefixes: [/a]\n", `{"upstream_host_rules":[{"host":"github.com","strip_path_prefixes":["/a"]}]}`, ""},
+		{"durations", "maintenance:\n  interval: 6h\nlimits:\n  ls_refs_cache_ttl: 10s\n", `{"limits":{"ls_refs_cache_ttl":"10s"},"maintenance":{"interval":"6h"}}`, ""},
+		{"int key", "admin:\n  8081: token\n", "", "non-string key 8081"},
+		{"bool key in a list", "upstream_credentials:\n  - true: x\n", "", "non-string key true"},
+		{"invalid YAML", "port: [8080\n", "", "yaml"},
+	}
+	for _, tc := range tests {
+		got, err := yamlToJSON([]byte(tc.in))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got %v, want an error with %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// withConfigFile makes loadServerConfig read a config file with the content.
+func withConfigFile(t *testing.T, name, content string) func() {
+	dir, err := ioutil.TempDir("", "goblet_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	old := *configFile
+	*configFile = path
+	return func() {
+		*configFile = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadServerConfig_YAML(t *testing.T) {
+	defer withConfigFile(t, "goblet.yaml", `
+listen_address: 127.0.0.1
+cache_root: /var/cache/goblet
+authorizer: none
+maintenance:
+  interval: 1h30m
+  tasks: [repack, commit-graph]
+limits:
+  ls_refs_cache_ttl: 10s
+offload:
+  bundle_uri_ttl: 6h
+`)()
+
+	c, err := loadServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddress != "127.0.0.1" {
+		t.Errorf("got listen_address %q, want 127.0.0.1", c.ListenAddress)
+	}
+	if got, want := time.Duration(c.Maintenance.Interval), 90*time.Minute; got != want {
+		t.Errorf("got maintenance.interval %v, want %v", got, want)
+	}
+	if got, want := time.Duration(c.Limits.LsRefsCacheTTL), 10*time.Second; got != want {
+		t.Errorf("got limits.ls_refs_cache_ttl %v, want %v", got, want)
+	}
+	if got, want := time.Duration(c.Offload.BundleURITTL), 6*time.Hour; got != want {
+		t.Errorf("got offload.bundle_uri_ttl %v, want %v", got, want)
+	}
+	// The fields not in the file are taken from the flags.
+	if c.Port != *port {
+		t.Errorf("got port %d, want the flag value %d", c.Port, *port)
+	}
+}
+
+func TestLoadServerConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr string
+	}{
+		{"duration without unit", "goblet.yaml", "cache_root: /c\nmaintenance:\n  interval: 10\n", "duration"},
+		{"invalid duration", "goblet.json", `{"cache_root": "/c", "limits": {"ls_refs_cache_ttl": "ten seconds"}}`, "duration"},
+		{"unknown field", "goblet.yml", "cache_root: /c\nprot: 8080\n", "prot"},
+		{"invalid value", "goblet.json", `{"cache_root": "/c", "port": 0}`, "port 0"},
+	}
+	for _, tc := range tests {
+		cleanup := withConfigFile(t, tc.file, tc.content)
+		_, err := loadServerConfig()
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: got %v, want an error with %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestApplyServerConfig(t *testing.T) {
+	current := validServerConfig()
+	current.UpstreamHostRules = []*goblet.UpstreamHostRule{{Host: "a.example.com"}}
+	r, err := newReloadableConfig(current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	canonicalizes := func(host string) bool {
+		_, err := r.canonicalizeURL(&url.URL{Scheme: "https", Host: host, Path: "/repo"})
+		return err == nil
+	}
+
+	// The upstream host rules and credentials are applied.
+	next := validServerConfig()
+	next.UpstreamHostRules = []*goblet.UpstreamHostRule{{Host: "b.example.com"}}
+	next.UpstreamCredentials = []*upstreamCredentialConfig{{URLPrefix: "https://b.example.com/", Type: "none"}}
+	got, err := applyServerConfig(current, next, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != next {
+		t.Error("got a configuration other than the reloaded one")
+	}
+	if canonicalizes("a.example.com") || !canonicalizes("b.example.com") {
+		t.Error("got the old upstream host rules after the reload")
+	}
+
+	// The other changes are rejected, and nothing is applied.
+	rejected := validServerConfig()
+	rejected.UpstreamHostRules = []*goblet.UpstreamHostRule{{Host: "c.example.com"}}
+	rejected.Port = 9090
+	rejected.Maintenance.Interval = duration(time.Hour)
+	_, err = applyServerConfig(next, rejected, r)
+	if err == nil {
+		t.Fatal("got no error for the non-reloadable changes")
+	}
+	for _, name := range []string{"port", "maintenance"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("got %v, want it to mention %s", err, name)
+		}
+	}
+	if strings.Contains(err.Error(), "upstream_host_rules") {
+		t.Errorf("got %v, want it not to mention the reloadable fields", err)
+	}
+	if canonicalizes("c.example.com") || !canonicalizes("b.example.com") {
+		t.Error("got the rejected upstream host rules applied")
+	}
+}
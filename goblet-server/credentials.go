@@ -0,0 +1,129 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/google/goblet"
+	"github.com/google/goblet/github"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// upstreamCredentialConfig is an entry of the upstream credentials.
+type upstreamCredentialConfig struct {
+	// URLPrefix is a prefix of the canonical upstream URLs that use this
+	// credential.
+	URLPrefix string `json:"url_prefix"`
+
+	// Type is one of "bearer", "basic", "google", "github_app", and "none".
+	Type string `json:"type"`
+
+	// Token or TokenFile is used for "bearer".
+	Token     string `json:"token,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+
+	// Username and Password or PasswordFile are used for "basic".
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"password_file,omitempty"`
+
+	// ServiceAccountKeyFile is used for "google". If empty, the server's
+	// default credential is used.
+	ServiceAccountKeyFile string `json:"service_account_key_file,omitempty"`
+
+	// AppID, PrivateKeyFile, and APIBaseURL are used for "github_app". The
+	// installation is selected by the owner of the upstream repository.
+	AppID          int64  `json:"app_id,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	APIBaseURL     string `json:"api_base_url,omitempty"`
+}
+
+func newCredentialProvider(configs []*upstreamCredentialConfig, defaultTokenSource oauth2.TokenSource) (goblet.CredentialProvider, error) {
+	m := goblet.URLPrefixCredentialProvider{}
+	for _, c := range configs {
+		if _, ok := m[c.URLPrefix]; ok {
+			return nil, fmt.Errorf("duplicated credential for %q", c.URLPrefix)
+		}
+		if c.URLPrefix != "" {
+			if u, err := url.Parse(c.URLPrefix); err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("the URL prefix %q must have a scheme and a host", c.URLPrefix)
+			}
+		}
+		switch c.Type {
+		case "bearer":
+			token, err := readSecret(c.Token, c.TokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read the token for %q: %v", c.URLPrefix, err)
+			}
+			m[c.URLPrefix] = goblet.NewStaticCredentialProvider(&goblet.Credential{BearerToken: token})
+		case "basic":
+			password, err := readSecret(c.Password, c.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read the password for %q: %v", c.URLPrefix, err)
+			}
+			m[c.URLPrefix] = goblet.NewStaticCredentialProvider(&goblet.Credential{Username: c.Username, Password: password})
+		case "google":
+			ts := defaultTokenSource
+			if c.ServiceAccountKeyFile != "" {
+				bs, err := ioutil.ReadFile(c.ServiceAccountKeyFile)
+				if err != nil {
+					return nil, fmt.Errorf("cannot read the service account key for %q: %v", c.URLPrefix, err)
+				}
+				creds, err := google.CredentialsFromJSON(context.Background(), bs, scopeCloudPlatform, scopeUserInfoEmail)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse the service account key for %q: %v", c.URLPrefix, err)
+				}
+				ts = creds.TokenSource
+			}
+			m[c.URLPrefix] = goblet.NewTokenSourceCredentialProvider(ts)
+		case "github_app":
+			bs, err := ioutil.ReadFile(c.PrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read the GitHub App private key for %q: %v", c.URLPrefix, err)
+			}
+			p, err := github.NewAppCredentialProvider(&github.AppConfig{
+				AppID:      c.AppID,
+				PrivateKey: bs,
+				APIBaseURL: c.APIBaseURL,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("cannot create the GitHub App credential for %q: %v", c.URLPrefix, err)
+			}
+			m[c.URLPrefix] = p
+		case "none":
+			m[c.URLPrefix] = goblet.NewStaticCredentialProvider(nil)
+		default:
+			return nil, fmt.Errorf("unknown credential type for %q: %q", c.URLPrefix, c.Type)
+		}
+	}
+	return m, nil
+}
+
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
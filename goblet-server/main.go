@@ -16,26 +16,40 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/logging"
 	"cloud.google.com/go/storage"
+	"contrib.go.opencensus.io/exporter/prometheus"
 	"contrib.go.opencensus.io/exporter/stackdriver"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/google/goblet"
+	"github.com/google/goblet/backup"
+	s3store "github.com/google/goblet/backup/s3"
 	googlehook "github.com/google/goblet/google"
 	"github.com/google/uuid"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	logpb "google.golang.org/genproto/googleapis/logging/v2"
 )
@@ -46,14 +60,52 @@ const (
 )
 
 var (
-	port      = flag.Int("port", 8080, "port to listen to")
-	cacheRoot = flag.String("cache_root", "", "Root directory of cached repositories")
+	configFile = flag.String("config", "", "JSON or YAML (.yaml, .yml) file of the server configuration. The settings in the file take precedence over the flags")
+
+	listenAddress = flag.String("listen_address", "", "Host or IP address to listen on. Empty means all interfaces")
+	port          = flag.Int("port", 8080, "port to listen to")
+	cacheRoot     = flag.String("cache_root", "", "Root directory of cached repositories")
+
+	adminListenAddress = flag.String("admin_listen_address", "", "Host or IP address to listen on for the admin API. Empty means all interfaces")
+	adminPort          = flag.Int("admin_port", 0, "port to listen to for the admin API. Zero disables the admin API")
+	adminTokenFile     = flag.String("admin_token_file", "", "File of the bearer token required for the admin API")
+
+	upstreamHostRules   = flag.String("upstream_host_rules", "", "JSON file of the upstream host rules. If not specified, only googlesource.com and source.developers.google.com are accepted")
+	upstreamCredentials = flag.String("upstream_credentials", "", "JSON file of the per-upstream credentials. If not specified, the server's default credential is used for all upstreams")
+
+	serveStaleLsRefs = flag.Bool("serve_stale_ls_refs", false, "Serve ls-refs from the local cache when the upstream is unavailable")
+	lsRefsCacheTTL   = flag.Duration("ls_refs_cache_ttl", 0, "Duration that an upstream ls-refs response is reused. Zero disables the cache")
+	cacheDiskQuota   = flag.Int64("cache_disk_quota_bytes", 0, "Disk budget of the cache root. The least recently used repositories are evicted when exceeded. Zero disables the eviction")
+
+	forwardPushes                = flag.Bool("forward_pushes", false, "Forward git-receive-pack to the upstream and fetch the pushed objects into the cache")
+	forwardPushClientCredentials = flag.Bool("forward_push_client_credentials", false, "Forward pushes with the client's Authorization header instead of the upstream credentials")
+
+	bundleURITTL           = flag.Duration("bundle_uri_ttl", 0, "Enables bundle-uri. A bundle served to the clients is recreated when it's older than this. Zero disables bundle-uri")
+	packfileURIMinBlobSize = flag.Int64("packfile_uri_min_blob_size", 0, "Enables packfile-uris. The blobs larger than this are served as a static pack. Zero disables packfile-uris")
+	packfileURIBaseURL     = flag.String("packfile_uri_base_url", "", "URL of this server that the clients download the static packs of packfile-uris from")
+
+	maintenanceInterval = flag.Duration("maintenance_interval", 0, "Interval of the background repository maintenance. Zero disables it")
+	maintenanceTasks    = flag.String("maintenance_tasks", "", "Comma-separated list of the maintenance tasks (gc, repack, commit-graph, multi-pack-index, pack-refs)")
+
+	prometheusMetrics    = flag.Bool("prometheus_metrics", false, "Serve the metrics in the Prometheus exposition format at /metrics on -metrics_port")
+	metricsListenAddress = flag.String("metrics_listen_address", "", "Host or IP address to listen on for the Prometheus metrics. Empty means all interfaces")
+	metricsPort          = flag.Int("metrics_port", 0, "port to listen to for the Prometheus metrics. Required for -prometheus_metrics")
+
+	traceExporter            = flag.String("trace_exporter", "none", "Trace exporter (none, stdout, stackdriver)")
+	traceSamplingProbability = flag.Float64("trace_sampling_probability", 0.01, "Probability that a request without a sampled trace context is traced")
 
 	stackdriverProject      = flag.String("stackdriver_project", "", "GCP project ID used for the Stackdriver integration")
 	stackdriverLoggingLogID = flag.String("stackdriver_logging_log_id", "", "Stackdriver logging Log ID")
 
-	backupBucketName   = flag.String("backup_bucket_name", "", "Name of the GCS bucket for backed-up repositories")
+	backupType         = flag.String("backup_type", "gcs", "Storage of the backup (gcs, s3, local)")
+	backupBucketName   = flag.String("backup_bucket_name", "", "Name of the GCS or S3 bucket for backed-up repositories")
+	backupLocalDir     = flag.String("backup_local_dir", "", "Directory for backed-up repositories, used with -backup_type=local")
 	backupManifestName = flag.String("backup_manifest_name", "", "Name of the backup manifest")
+	backupS3Endpoint   = flag.String("backup_s3_endpoint", "", "Endpoint of an S3-compatible storage. If not specified, Amazon S3 is used")
+	backupS3Region     = flag.String("backup_s3_region", "", "Region of the S3 bucket")
+
+	backupLazyRestore        = flag.Bool("backup_lazy_restore", false, "Restore the repositories from the backup when they're first requested instead of at startup")
+	backupRestoreConcurrency = flag.Int("backup_restore_concurrency", 4, "Number of the repositories restored from the backup in parallel at startup")
 
 	latencyDistributionAggregation = view.Distribution(
 		100,
@@ -112,19 +164,66 @@ var (
 			Measure:     goblet.UpstreamFetchWaitingTime,
 			Aggregation: latencyDistributionAggregation,
 		},
+		{
+			Name:        "github.com/google/goblet/cache-disk-usage",
+			Description: "Disk usage of the cached repositories",
+			Measure:     goblet.CacheDiskUsage,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "github.com/google/goblet/cache-eviction-count",
+			Description: "Number of repositories evicted from the cache",
+			Measure:     goblet.CacheEvictionCount,
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "github.com/google/goblet/managed-repository-count",
+			Description: "Number of managed repositories",
+			Measure:     goblet.ManagedRepositoryCount,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "github.com/google/goblet/upstream-fetch-in-flight-count",
+			Description: "Number of running git-fetch from the upstream",
+			Measure:     goblet.UpstreamFetchInFlightCount,
+			Aggregation: view.LastValue(),
+		},
+		{
+			Name:        "github.com/google/goblet/upstream-fetch-waiting-client-count",
+			Description: "Number of requests waiting for git-fetch from the upstream",
+			Measure:     goblet.UpstreamFetchWaitingClientCount,
+			Aggregation: view.LastValue(),
+		},
 	}
 )
 
 func main() {
 	flag.Parse()
 
-	ts, err := google.DefaultTokenSource(context.Background(), scopeCloudPlatform, scopeUserInfoEmail)
+	c, err := loadServerConfig()
 	if err != nil {
-		log.Fatalf("Cannot initialize the OAuth2 token source: %v", err)
+		log.Fatal(err)
 	}
-	authorizer, err := googlehook.NewRequestAuthorizer(ts)
+
+	ts, err := google.DefaultTokenSource(context.Background(), scopeCloudPlatform, scopeUserInfoEmail)
 	if err != nil {
-		log.Fatalf("Cannot create a request authorizer: %v", err)
+		if c.Authorizer == "google" {
+			log.Fatalf("Cannot initialize the OAuth2 token source: %v", err)
+		}
+		// The default credential is not needed if the upstreams use
+		// the other credentials.
+		log.Printf("The default credential is not available: %v", err)
+		ts = errorTokenSource{err}
+	}
+	var authorizer func(*http.Request) error
+	switch c.Authorizer {
+	case "google":
+		authorizer, err = googlehook.NewRequestAuthorizer(ts)
+		if err != nil {
+			log.Fatalf("Cannot create a request authorizer: %v", err)
+		}
+	case "none":
+		authorizer = func(*http.Request) error { return nil }
 	}
 	if err := view.Register(views...); err != nil {
 		log.Fatal(err)
@@ -143,9 +242,10 @@ func main() {
 		return &logBasedOperation{action, u}
 	}
 	var backupLogger *log.Logger = log.New(os.Stderr, "", log.LstdFlags)
-	if *stackdriverProject != "" {
+	var sdExporter *stackdriver.Exporter
+	if c.Logging.StackdriverProject != "" {
 		// Error reporter
-		ec, err := errorreporting.NewClient(context.Background(), *stackdriverProject, errorreporting.Config{
+		ec, err := errorreporting.NewClient(context.Background(), c.Logging.StackdriverProject, errorreporting.Config{
 			ServiceName: "goblet",
 		})
 		if err != nil {
@@ -164,8 +264,8 @@ func main() {
 			log.Printf("Error while processing a request: %v", err)
 		}
 
-		if *stackdriverLoggingLogID != "" {
-			lc, err := logging.NewClient(context.Background(), *stackdriverProject)
+		if c.Logging.StackdriverLoggingLogID != "" {
+			lc, err := logging.NewClient(context.Background(), c.Logging.StackdriverProject)
 			if err != nil {
 				log.Fatalf("Cannot create a Stackdriver logging client: %v", err)
 			}
@@ -176,7 +276,7 @@ func main() {
 			}()
 
 			// Request logger
-			sdLogger := lc.Logger(*stackdriverLoggingLogID)
+			sdLogger := lc.Logger(c.Logging.StackdriverLoggingLogID)
 			rl = func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
 				sdLogger.Log(logging.Entry{
 					HTTPRequest: &logging.HTTPRequest{
@@ -215,42 +315,174 @@ func main() {
 		}
 
 		// OpenCensus view exporters.
-		exporter, err := stackdriver.NewExporter(stackdriver.Options{
-			ProjectID: *stackdriverProject,
+		sdExporter, err = stackdriver.NewExporter(stackdriver.Options{
+			ProjectID: c.Logging.StackdriverProject,
 		})
 		if err != nil {
 			log.Fatal(err)
 		}
-		if err = exporter.StartMetricsExporter(); err != nil {
+		if err = sdExporter.StartMetricsExporter(); err != nil {
 			log.Fatal(err)
 		}
 	}
+	if err := setupTracing(c.Tracing.Exporter, c.Tracing.SamplingProbability, sdExporter, os.Stdout); err != nil {
+		log.Fatalf("Cannot set up tracing: %v", err)
+	}
+	if c.Metrics.Prometheus {
+		// The Prometheus exporter is a pull-based exporter and works
+		// with the Stackdriver exporter. The metrics are served on
+		// their own port so that they are not exposed with the Git
+		// endpoints.
+		exporter, err := prometheus.NewExporter(prometheus.Options{})
+		if err != nil {
+			log.Fatalf("Cannot create a Prometheus exporter: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", exporter)
+		go func() {
+			log.Fatal(listenAndServe(c.Metrics.ListenAddress, c.Metrics.Port, c.TLS, mux))
+		}()
+	}
 
+	// The upstream host rules and credentials are reloaded on SIGHUP.
+	reloadable, err := newReloadableConfig(c, ts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		current := c
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGHUP)
+		for range ch {
+			newConfig, err := reloadServerConfig(current, reloadable)
+			if err != nil {
+				log.Printf("Cannot reload the configuration: %v", err)
+				continue
+			}
+			current = newConfig
+			log.Printf("Reloaded the upstream host rules and credentials")
+		}
+	}()
+
+	maintenanceTasks, err := c.maintenanceTasks()
+	if err != nil {
+		log.Fatal(err)
+	}
 	config := &goblet.ServerConfig{
-		LocalDiskCacheRoot:         *cacheRoot,
-		URLCanonializer:            googlehook.CanonicalizeURL,
-		RequestAuthorizer:          authorizer,
-		TokenSource:                ts,
-		ErrorReporter:              er,
-		RequestLogger:              rl,
-		LongRunningOperationLogger: lrol,
+		LocalDiskCacheRoot:           c.CacheRoot,
+		URLCanonializer:              reloadable.canonicalizeURL,
+		RequestAuthorizer:            authorizer,
+		TokenSource:                  ts,
+		CredentialProvider:           reloadable,
+		ErrorReporter:                er,
+		RequestLogger:                rl,
+		LongRunningOperationLogger:   lrol,
+		ServeStaleLsRefs:             c.Limits.ServeStaleLsRefs,
+		LsRefsCacheTTL:               time.Duration(c.Limits.LsRefsCacheTTL),
+		CacheDiskQuotaBytes:          c.Limits.CacheDiskQuotaBytes,
+		MaintenanceInterval:          time.Duration(c.Maintenance.Interval),
+		MaintenanceTasks:             maintenanceTasks,
+		ForwardPushes:                c.Push.Forward,
+		ForwardPushClientCredentials: c.Push.ForwardClientCredentials,
+		BundleURITTL:                 time.Duration(c.Offload.BundleURITTL),
+		PackfileURIMinBlobSize:       c.Offload.PackfileURIMinBlobSize,
+		PackfileURIBaseURL:           c.Offload.PackfileURIBaseURL,
 	}
 
-	if *backupBucketName != "" && *backupManifestName != "" {
-		gsClient, err := storage.NewClient(context.Background())
+	if c.Backup.enabled() {
+		store, err := newBackupObjectStore(&c.Backup)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("Cannot create the backup storage: %v", err)
 		}
-
-		googlehook.RunBackupProcess(config, gsClient.Bucket(*backupBucketName), *backupManifestName, backupLogger)
+		rw := &backup.ReaderWriter{
+			Store:              store,
+			ManifestName:       c.Backup.ManifestName,
+			Config:             config,
+			Logger:             backupLogger,
+			RestoreConcurrency: c.Backup.RestoreConcurrency,
+			LazyRestore:        c.Backup.LazyRestore,
+		}
+		if c.Backup.LazyRestore {
+			config.RepositoryRestorer = rw.RestoreRepository
+		}
+		// The restores run in the background. The requests to a
+		// repository being restored wait for it.
+		rw.Run()
 	}
+	goblet.RunMaintenanceProcess(config)
 
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		io.WriteString(w, "ok\n")
 	})
+	if c.Admin.Port != 0 {
+		token, err := readSecret("", c.Admin.TokenFile)
+		if err != nil {
+			log.Fatalf("Cannot read the admin token: %v", err)
+		}
+		config.AdminRequestAuthorizer = newAdminRequestAuthorizer(token)
+		go func() {
+			log.Fatal(listenAndServe(c.Admin.ListenAddress, c.Admin.Port, c.TLS, goblet.AdminHTTPHandler(config)))
+		}()
+	}
+
 	http.Handle("/", goblet.HTTPHandler(config))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	log.Fatal(listenAndServe(c.ListenAddress, c.Port, c.TLS, nil))
+}
+
+func listenAndServe(host string, port int, tls tlsConfig, handler http.Handler) error {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if tls.CertFile != "" {
+		return http.ListenAndServeTLS(addr, tls.CertFile, tls.KeyFile, handler)
+	}
+	return http.ListenAndServe(addr, handler)
+}
+
+func newBackupObjectStore(c *backupConfig) (backup.ObjectStore, error) {
+	switch c.Type {
+	case "gcs":
+		gsClient, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return googlehook.NewGCSObjectStore(gsClient.Bucket(c.BucketName)), nil
+	case "s3":
+		// The credentials and the region are also read from the
+		// environment.
+		cfg := aws.NewConfig().WithS3ForcePathStyle(c.S3ForcePathStyle)
+		if c.S3Endpoint != "" {
+			cfg = cfg.WithEndpoint(c.S3Endpoint)
+		}
+		if c.S3Region != "" {
+			cfg = cfg.WithRegion(c.S3Region)
+		}
+		sess, err := session.NewSession(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return s3store.NewObjectStore(awss3.New(sess), c.BucketName), nil
+	case "local":
+		return backup.NewLocalObjectStore(c.LocalDir), nil
+	}
+	return nil, fmt.Errorf("unknown backup type: %q", c.Type)
+}
+
+type errorTokenSource struct {
+	err error
+}
+
+func (ts errorTokenSource) Token() (*oauth2.Token, error) {
+	return nil, ts.err
+}
+
+func newAdminRequestAuthorizer(token string) func(*http.Request) error {
+	want := []byte("Bearer " + token)
+	return func(r *http.Request) error {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			return status.Error(codes.Unauthenticated, "not a valid admin token")
+		}
+		return nil
+	}
 }
 
 type LongRunningOperation struct {
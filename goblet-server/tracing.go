@@ -0,0 +1,94 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	"go.opencensus.io/trace"
+)
+
+// setupTracing registers the trace exporter. sdExporter is used for
+// "stackdriver" and can be nil for the other exporters.
+func setupTracing(exporterName string, samplingProbability float64, sdExporter *stackdriver.Exporter, stdout io.Writer) error {
+	switch exporterName {
+	case "", "none":
+		return nil
+	case "stdout":
+		trace.RegisterExporter(&jsonTraceExporter{enc: json.NewEncoder(stdout)})
+	case "stackdriver":
+		if sdExporter == nil {
+			return fmt.Errorf("-stackdriver_project is required for the stackdriver trace exporter")
+		}
+		trace.RegisterExporter(sdExporter)
+	default:
+		return fmt.Errorf("unknown trace exporter: %q", exporterName)
+	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(samplingProbability)})
+	return nil
+}
+
+// jsonTraceExporter writes the spans as JSON lines. This is intended for
+// local testing.
+type jsonTraceExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+type jsonSpan struct {
+	TraceID      string                 `json:"trace_id"`
+	SpanID       string                 `json:"span_id"`
+	ParentSpanID string                 `json:"parent_span_id,omitempty"`
+	Name         string                 `json:"name"`
+	StartTime    time.Time              `json:"start_time"`
+	EndTime      time.Time              `json:"end_time"`
+	Duration     string                 `json:"duration"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	StatusCode   int32                  `json:"status_code,omitempty"`
+	Status       string                 `json:"status,omitempty"`
+	Links        []string               `json:"links,omitempty"`
+}
+
+func (e *jsonTraceExporter) ExportSpan(s *trace.SpanData) {
+	js := &jsonSpan{
+		TraceID:    s.TraceID.String(),
+		SpanID:     s.SpanID.String(),
+		Name:       s.Name,
+		StartTime:  s.StartTime,
+		EndTime:    s.EndTime,
+		Duration:   s.EndTime.Sub(s.StartTime).String(),
+		Attributes: s.Attributes,
+		StatusCode: s.Code,
+		Status:     s.Message,
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		js.ParentSpanID = s.ParentSpanID.String()
+	}
+	for _, l := range s.Links {
+		js.Links = append(js.Links, l.TraceID.String()+"/"+l.SpanID.String())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.enc.Encode(js); err != nil {
+		log.Printf("Cannot export a span: %v", err)
+	}
+}
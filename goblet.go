@@ -31,7 +31,8 @@ var (
 	CommandTypeKey = tag.MustNewKey("github.com/google/goblet/command-type")
 
 	// CommandCacheStateKey indicates whether the command response is cached
-	// or not ("locally-served", "queried-upstream").
+	// or not ("locally-served", "locally-cached", "queried-upstream",
+	// "served-stale").
 	CommandCacheStateKey = tag.MustNewKey("github.com/google/goblet/command-cache-state")
 
 	// CommandCanonicalStatusKey indicates whether the command is succeeded
@@ -55,6 +56,25 @@ var (
 
 	// OutboundCommandCount is a count of outbound commands.
 	OutboundCommandCount = stats.Int64("github.com/google/goblet/outbound-command-count", "number of outbound commands", stats.UnitDimensionless)
+
+	// CacheDiskUsage is a total size of the cached repositories. This is
+	// recorded only when ServerConfig.CacheDiskQuotaBytes is set.
+	CacheDiskUsage = stats.Int64("github.com/google/goblet/cache-disk-usage", "disk usage of the cached repositories", stats.UnitBytes)
+
+	// CacheEvictionCount is a count of the repositories evicted from the
+	// cache.
+	CacheEvictionCount = stats.Int64("github.com/google/goblet/cache-eviction-count", "number of evicted repositories", stats.UnitDimensionless)
+
+	// ManagedRepositoryCount is a number of the managed repositories.
+	ManagedRepositoryCount = stats.Int64("github.com/google/goblet/managed-repository-count", "number of managed repositories", stats.UnitDimensionless)
+
+	// UpstreamFetchInFlightCount is a number of the running upstream
+	// fetches.
+	UpstreamFetchInFlightCount = stats.Int64("github.com/google/goblet/upstream-fetch-in-flight-count", "number of running upstream fetches", stats.UnitDimensionless)
+
+	// UpstreamFetchWaitingClientCount is a number of the requests waiting
+	// for the upstream fetches.
+	UpstreamFetchWaitingClientCount = stats.Int64("github.com/google/goblet/upstream-fetch-waiting-client-count", "number of requests waiting for upstream fetches", stats.UnitDimensionless)
 )
 
 type ServerConfig struct {
@@ -64,13 +84,79 @@ type ServerConfig struct {
 
 	RequestAuthorizer func(*http.Request) error
 
+	// AdminRequestAuthorizer authorizes the requests to AdminHTTPHandler.
+	// If nil, the admin API rejects all requests.
+	AdminRequestAuthorizer func(*http.Request) error
+
 	TokenSource oauth2.TokenSource
 
+	// CredentialProvider provides the credentials for the upstream
+	// repositories. If nil, TokenSource is used for all upstreams.
+	CredentialProvider CredentialProvider
+
 	ErrorReporter func(*http.Request, error)
 
 	RequestLogger func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
 
 	LongRunningOperationLogger func(string, *url.URL) RunningOperation
+
+	// ServeStaleLsRefs makes ls-refs served from the local cache when the
+	// upstream is unavailable.
+	ServeStaleLsRefs bool
+
+	// LsRefsCacheTTL is a duration that an upstream ls-refs response is
+	// reused for the same repository and the same arguments. Zero disables
+	// the cache.
+	LsRefsCacheTTL time.Duration
+
+	// CacheDiskQuotaBytes is a disk budget for LocalDiskCacheRoot. When the
+	// cached repositories exceed this, the least recently used ones are
+	// evicted. Zero disables the eviction.
+	CacheDiskQuotaBytes int64
+
+	// MaintenanceInterval is an interval of the background repository
+	// maintenance started by RunMaintenanceProcess. Zero disables it. The
+	// requests are served while a repository is maintained, except for
+	// MaintenanceGC.
+	MaintenanceInterval time.Duration
+
+	// MaintenanceTasks is a list of the tasks run in the repository
+	// maintenance. DefaultMaintenanceTasks is used if empty.
+	MaintenanceTasks []MaintenanceTask
+
+	// ForwardPushes makes git-receive-pack forwarded to the upstream. After
+	// a successful push, the repository is fetched from the upstream.
+	ForwardPushes bool
+
+	// ForwardPushClientCredentials makes the forwarded pushes use the
+	// client's Authorization header instead of the upstream credentials.
+	ForwardPushClientCredentials bool
+
+	// BundleURITTL enables the bundle-uri command. The clients download a
+	// bundle of the local cache served by HTTPHandler before fetching. The
+	// bundle is recreated in the background when it's older than this. Zero
+	// disables bundle-uri.
+	BundleURITTL time.Duration
+
+	// PackfileURIMinBlobSize enables the packfile-uris fetch feature. The
+	// blobs larger than this are packed into a static pack served by
+	// HTTPHandler, and the clients that support packfile-uris download it
+	// instead of receiving the blobs in the fetch response. Zero disables
+	// packfile-uris.
+	PackfileURIMinBlobSize int64
+
+	// PackfileURIBaseURL is the URL of HTTPHandler that the clients
+	// download the static packs from, such as
+	// "https://goblet.example.com". The pack URIs are made from this
+	// instead of the request so that a client cannot choose the URIs
+	// served to the others. packfile-uris is disabled if this is empty.
+	PackfileURIBaseURL string
+
+	// RepositoryRestorer seeds a repository that doesn't exist in
+	// LocalDiskCacheRoot, such as from a backup bundle, before the first
+	// upstream fetch. The requests to the repository wait for it. If this
+	// fails, the repository is fetched from the upstream as usual.
+	RepositoryRestorer func(ManagedRepository) error
 }
 
 type RunningOperation interface {
@@ -84,9 +170,15 @@ type ManagedRepository interface {
 
 	LastUpdateTime() time.Time
 
-	RecoverFromBundle(string) error
+	RecoverFromBundle(...string) error
 
 	WriteBundle(io.Writer) error
+
+	WriteIncrementalBundle(io.Writer, map[string]string) (map[string]string, error)
+
+	VerifyBundle(string) error
+
+	RunMaintenance() error
 }
 
 func HTTPHandler(config *ServerConfig) http.Handler {
@@ -15,289 +15,90 @@
 package google
 
 import (
-	"bufio"
 	"context"
-	"fmt"
 	"io"
 	"log"
-	"net/url"
-	"os"
-	"path"
-	"path/filepath"
-	"sort"
-	"strconv"
 	"strings"
-	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/google/goblet"
+	"github.com/google/goblet/backup"
 	"google.golang.org/api/iterator"
 )
 
-const (
-	gobletRepoManifestDir = "goblet-repository-manifests"
-
-	manifestCleanUpDuration = 24 * time.Hour
-
-	backupFrequency = time.Hour
-)
-
+// RunBackupProcess runs backup.RunBackupProcess with the GCS bucket.
 func RunBackupProcess(config *goblet.ServerConfig, bh *storage.BucketHandle, manifestName string, logger *log.Logger) {
-	rw := &backupReaderWriter{
-		bucketHandle: bh,
-		manifestName: manifestName,
-		config:       config,
-		logger:       logger,
-	}
-	rw.recoverFromBackup()
-	go func() {
-		timer := time.NewTimer(backupFrequency)
-		for {
-			select {
-			case <-timer.C:
-				rw.saveBackup()
-			}
-			timer.Reset(backupFrequency)
-		}
-	}()
+	backup.RunBackupProcess(config, NewGCSObjectStore(bh), manifestName, logger)
 }
 
-type backupReaderWriter struct {
+// GCSObjectStore is a backup.ObjectStore backed by a GCS bucket.
+type GCSObjectStore struct {
 	bucketHandle *storage.BucketHandle
-	manifestName string
-	config       *goblet.ServerConfig
-	logger       *log.Logger
 }
 
-func (b *backupReaderWriter) recoverFromBackup() {
-	repos := b.readRepoList()
-	if repos == nil || len(repos) == 0 {
-		b.logger.Print("No repositories found from backup")
-		return
-	}
-
-	for rawURL, _ := range repos {
-		u, err := url.Parse(rawURL)
-		if err != nil {
-			b.logger.Printf("Cannot parse %s as a URL. Skipping", rawURL)
-			continue
-		}
-
-		bundlePath, err := b.downloadBackupBundle(path.Join(u.Host, u.Path))
-		if err != nil {
-			b.logger.Printf("Cannot find the backup bundle for %s. Skipping: %v", rawURL, err)
-			continue
-		}
-
-		m, err := goblet.OpenManagedRepository(b.config, u)
-		if err != nil {
-			b.logger.Printf("Cannot open a managed repository for %s. Skipping: %v", rawURL, err)
-			continue
-		}
-
-		m.RecoverFromBundle(bundlePath)
-		os.Remove(bundlePath)
-	}
+// NewGCSObjectStore returns a backup.ObjectStore of the bucket.
+func NewGCSObjectStore(bh *storage.BucketHandle) *GCSObjectStore {
+	return &GCSObjectStore{bucketHandle: bh}
 }
 
-func (b *backupReaderWriter) readRepoList() map[string]bool {
-	it := b.bucketHandle.Objects(context.Background(), &storage.Query{
+func (s *GCSObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	it := s.bucketHandle.Objects(ctx, &storage.Query{
 		Delimiter: "/",
-		Prefix:    path.Join(gobletRepoManifestDir, b.manifestName) + "/",
-	})
-	repos := map[string]bool{}
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			b.logger.Printf("Error while finding the manifests: %v", err)
-			return nil
-		}
-		if attrs.Name == "" {
-			continue
-		}
-
-		b.readManifest(attrs.Name, repos)
-	}
-	return repos
-}
-
-func (b *backupReaderWriter) readManifest(name string, m map[string]bool) {
-	rc, err := b.bucketHandle.Object(name).NewReader(context.Background())
-	if err != nil {
-		b.logger.Printf("Cannot open a manifest file %s. Skipping: %v", name, err)
-		return
-	}
-	defer rc.Close()
-
-	sc := bufio.NewScanner(rc)
-	for sc.Scan() {
-		m[strings.TrimSpace(sc.Text())] = true
-	}
-	if err := sc.Err(); err != nil {
-		b.logger.Printf("Error while reading a manifest file %s. Skipping the rest of the file: %v", name, err)
-	}
-}
-
-func (b *backupReaderWriter) downloadBackupBundle(name string) (string, error) {
-	_, name, err := b.gcBundle(name)
-	if name == "" {
-		return "", fmt.Errorf("cannot find the bundle for %s: %v", name, err)
-	}
-
-	rc, err := b.bucketHandle.Object(name).NewReader(context.Background())
-	if err != nil {
-		return "", err
-	}
-	defer rc.Close()
-
-	tmpBundlePath := filepath.Join(b.config.LocalDiskCacheRoot, "tmp-bundle")
-	fi, err := os.OpenFile(tmpBundlePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-	if err != nil {
-		return "", err
-	}
-	defer fi.Close()
-
-	if _, err := io.Copy(fi, rc); err != nil {
-		return "", err
-	}
-	return tmpBundlePath, nil
-}
-
-func (b *backupReaderWriter) saveBackup() {
-	urls := []string{}
-	goblet.ListManagedRepositories(func(m goblet.ManagedRepository) {
-		u := m.UpstreamURL()
-		latestBundleSecPrecision, _, err := b.gcBundle(path.Join(u.Host, u.Path))
-		if err != nil {
-			b.logger.Printf("cannot GC bundles for %s. Skipping: %v", u.String(), err)
-			return
-		}
-		// The bundle timestmap is seconds precision.
-		if latestBundleSecPrecision.Unix() >= m.LastUpdateTime().Unix() {
-			b.logger.Printf("existing bundle for %s is up-to-date %s", u.String(), latestBundleSecPrecision.Format(time.RFC3339))
-		} else if err := b.backupManagedRepo(m); err != nil {
-			b.logger.Printf("cannot make a backup for %s. Skipping: %v", u.String(), err)
-			return
-		}
-
-		urls = append(urls, u.String())
+		Prefix:    prefix,
 	})
-
-	now := time.Now()
-	manifestFile := path.Join(gobletRepoManifestDir, b.manifestName, fmt.Sprintf("%012d", now.Unix()))
-	if err := b.writeManifestFile(manifestFile, urls); err != nil {
-		b.logger.Printf("cannot create %s: %v", manifestFile, err)
-		return
-	}
-
-	b.garbageCollectOldManifests(now)
-}
-
-func (b *backupReaderWriter) gcBundle(name string) (time.Time, string, error) {
 	names := []string{}
-	it := b.bucketHandle.Objects(context.Background(), &storage.Query{
-		Delimiter: "/",
-		Prefix:    name + "/",
-	})
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return time.Time{}, "", fmt.Errorf("error while finding the bundles to GC: %v", err)
+			return nil, err
 		}
+		// Skip the synthesized prefixes.
 		if attrs.Name == "" {
 			continue
 		}
-
 		names = append(names, attrs.Name)
 	}
-
-	bundles := []string{}
-	for _, name := range names {
-		// Ignore non-bundles.
-		if _, err := strconv.ParseInt(path.Base(names[0]), 10, 64); err != nil {
-			continue
-		}
-		bundles = append(bundles, name)
-	}
-
-	if len(bundles) == 0 {
-		// No backup found.
-		return time.Time{}, "", nil
-	}
-	sort.Sort(sort.Reverse(sort.StringSlice(bundles)))
-
-	for _, name := range bundles[1:len(bundles)] {
-		b.bucketHandle.Object(name).Delete(context.Background())
-	}
-	n, _ := strconv.ParseInt(path.Base(bundles[0]), 10, 64)
-	return time.Unix(n, 0), bundles[0], nil
+	return names, nil
 }
 
-func (b *backupReaderWriter) backupManagedRepo(m goblet.ManagedRepository) error {
-	u := m.UpstreamURL()
-	bundleFile := path.Join(u.Host, u.Path, fmt.Sprintf("%012d", m.LastUpdateTime().Unix()))
+func (s *GCSObjectStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.bucketHandle.Object(name).NewReader(ctx)
+}
 
-	ctx, cf := context.WithCancel(context.Background())
+func (s *GCSObjectStore) Write(ctx context.Context, name string, metadata map[string]string, write func(io.Writer) error) error {
+	ctx, cf := context.WithCancel(ctx)
 	defer cf()
 
-	wc := b.bucketHandle.Object(bundleFile).NewWriter(ctx)
-	if err := m.WriteBundle(wc); err != nil {
+	wc := s.bucketHandle.Object(name).NewWriter(ctx)
+	wc.Metadata = metadata
+	if err := write(wc); err != nil {
+		// The cancelled context discards the object.
+		cf()
+		wc.Close()
 		return err
 	}
-	// Closing here will commit the file. Otherwise, the cancelled context
-	// will discard the file.
-	wc.Close()
-	return nil
+	// Closing here will commit the object.
+	return wc.Close()
 }
 
-func (b *backupReaderWriter) writeManifestFile(manifestFile string, urls []string) error {
-	ctx, cf := context.WithCancel(context.Background())
-	defer cf()
-
-	wc := b.bucketHandle.Object(manifestFile).NewWriter(ctx)
-	for _, url := range urls {
-		if _, err := io.WriteString(wc, url+"\n"); err != nil {
-			return err
-		}
+func (s *GCSObjectStore) Metadata(ctx context.Context, name string) (map[string]string, error) {
+	attrs, err := s.bucketHandle.Object(name).Attrs(ctx)
+	if err != nil {
+		return nil, err
 	}
-	// Closing here will commit the file. Otherwise, the cancelled context
-	// will discard the file.
-	wc.Close()
-	return nil
+	metadata := map[string]string{}
+	for k, v := range attrs.Metadata {
+		metadata[strings.ToLower(k)] = v
+	}
+	return metadata, nil
 }
 
-func (b *backupReaderWriter) garbageCollectOldManifests(now time.Time) {
-	threshold := now.Add(-manifestCleanUpDuration)
-	it := b.bucketHandle.Objects(context.Background(), &storage.Query{
-		Delimiter: "/",
-		Prefix:    path.Join(gobletRepoManifestDir, b.manifestName) + "/",
-	})
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			b.logger.Printf("Error while finding the manifests to GC: %v", err)
-			return
-		}
-		if attrs.Prefix != "" {
-			continue
-		}
-
-		sec, err := strconv.ParseInt(path.Base(attrs.Name), 10, 64)
-		if err != nil {
-			continue
-		}
-		t := time.Unix(sec, 0)
-		if t.Before(threshold) {
-			b.bucketHandle.Object(attrs.Name).Delete(context.Background())
-		}
+func (s *GCSObjectStore) Delete(ctx context.Context, name string) error {
+	if err := s.bucketHandle.Object(name).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
 	}
+	return nil
 }
@@ -17,11 +17,18 @@ package goblet
 import (
 	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/google/gitprotocolio"
+	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -33,6 +40,11 @@ type httpProxyServer struct {
 func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w, logCloser := logHTTPRequest(s.config, w, r)
 	defer logCloser()
+	r, span := startRequestSpan(r)
+	defer func() {
+		span.AddAttributes(trace.Int64Attribute(ochttp.StatusCodeAttribute, int64(w.(*monitoringWriter).status)))
+		span.End()
+	}()
 	reporter := &httpErrorReporter{config: s.config, req: r, w: w}
 
 	ctx, err := tag.New(r.Context(), tag.Insert(CommandTypeKey, "not-a-command"))
@@ -46,23 +58,85 @@ func (s *httpProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Proxy-Authorization / Proxy-Authenticate. However, existing
 	// authentication mechanism around Git is not compatible with proxy
 	// authorization. We use normal authentication mechanism here.
-	if err := s.config.RequestAuthorizer(r); err != nil {
+	authzCtx, authzSpan := trace.StartSpan(r.Context(), "goblet/authorize")
+	err = s.config.RequestAuthorizer(r.WithContext(authzCtx))
+	endSpan(authzSpan, err)
+	if err != nil {
 		reporter.reportError(err)
 		return
 	}
-	if proto := r.Header.Get("Git-Protocol"); proto != "version=2" {
-		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only Git protocol v2"))
-		return
-	}
+	version := gitProtocolVersion(r.Header.Get("Git-Protocol"))
 
 	switch {
+	case strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == "git-receive-pack":
+		s.receivePackHandler(reporter, w, r)
 	case strings.HasSuffix(r.URL.Path, "/info/refs"):
-		s.infoRefsHandler(reporter, w, r)
+		if version == 2 {
+			s.infoRefsHandler(reporter, w, r)
+		} else {
+			s.infoRefsV1Handler(reporter, w, r, version)
+		}
 	case strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
-		reporter.reportError(status.Error(codes.Unimplemented, "git-receive-pack not supported"))
+		s.receivePackHandler(reporter, w, r)
+	case strings.HasSuffix(r.URL.Path, bundleURISuffix):
+		s.bundleHandler(reporter, w, r)
+	case strings.Contains(r.URL.Path, packfileURIPath):
+		s.packfileHandler(reporter, w, r)
 	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
-		s.uploadPackHandler(reporter, w, r)
+		if version == 2 {
+			s.uploadPackHandler(reporter, w, r)
+		} else {
+			s.uploadPackV1Handler(reporter, w, r)
+		}
+	}
+}
+
+// serveRepositoryFile serves a file in the repository directory. repoPath is
+// the path of the repository URL.
+func (s *httpProxyServer) serveRepositoryFile(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, repoPath, name string) {
+	u := *r.URL
+	u.Path = repoPath
+	repo, err := openManagedRepository(s.config, &u)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	if err := repo.waitForRestore(r.Context()); err != nil {
+		reporter.reportError(err)
+		return
 	}
+	serveFile(reporter, w, r, filepath.Join(repo.localDiskPath, name))
+}
+
+func serveFile(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.NotFound, "%s not found", path.Base(name)))
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// gitProtocolVersion returns the protocol version requested by the
+// Git-Protocol header. Zero means the protocol v0.
+func gitProtocolVersion(h string) int {
+	version := 0
+	for _, param := range strings.Split(h, ":") {
+		switch param {
+		case "version=1":
+			version = 1
+		case "version=2":
+			version = 2
+		}
+	}
+	return version
 }
 
 func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
@@ -71,15 +145,22 @@ func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.Re
 		return
 	}
 
+	// See serveFetchLocal for the consistency of ref-in-want.
+	fetchFeatures := "fetch=filter shallow ref-in-want"
+	if packfileURIsEnabled(s.config) {
+		fetchFeatures += " sideband-all packfile-uris"
+	}
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-advertisement")
 	rs := []*gitprotocolio.InfoRefsResponseChunk{
 		{ProtocolVersion: 2},
 		{Capabilities: []string{"ls-refs"}},
-		// See managed_repositories.go for not having ref-in-want.
-		{Capabilities: []string{"fetch=filter shallow"}},
+		{Capabilities: []string{fetchFeatures}},
 		{Capabilities: []string{"server-option"}},
-		{EndOfRequest: true},
 	}
+	if s.config.BundleURITTL != 0 {
+		rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{Capabilities: []string{"bundle-uri"}})
+	}
+	rs = append(rs, &gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true})
 	for _, pkt := range rs {
 		if err := writePacket(w, pkt); err != nil {
 			// Client-side IO error. Treat this as Canceled.
@@ -89,16 +170,68 @@ func (s *httpProxyServer) infoRefsHandler(reporter *httpErrorReporter, w http.Re
 	}
 }
 
+func (s *httpProxyServer) infoRefsV1Handler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request, version int) {
+	if r.URL.Query().Get("service") != "git-upload-pack" {
+		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only git-fetch"))
+		return
+	}
+
+	startTime := time.Now()
+	ctx, err := tag.New(r.Context(), tag.Upsert(CommandTypeKey, "ls-refs"))
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	r = r.WithContext(ctx)
+	reporter.req = r
+
+	repo, err := openManagedRepository(s.config, r.URL)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	if err := repo.waitForRestore(ctx); err != nil {
+		reporter.reportError(err)
+		return
+	}
+
+	resp, cacheState, lsRefsErr := repo.lsRefs(ctx, lsRefsForV1Advertisement)
+	ctx, err = tag.New(ctx, tag.Upsert(CommandCacheStateKey, cacheState))
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	r = r.WithContext(ctx)
+	reporter.req = r
+	if lsRefsErr != nil {
+		reporter.reportError(lsRefsErr)
+		return
+	}
+
+	rs, err := v1RefAdvertisement(resp, version)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-advertisement")
+	for _, pkt := range rs {
+		if err := writePacket(w, pkt); err != nil {
+			// Client-side IO error. Treat this as Canceled.
+			reporter.reportError(status.Errorf(codes.Canceled, "client IO error"))
+			return
+		}
+	}
+	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+	gitReporter.reportError(ctx, startTime, nil)
+}
+
 func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
 	// /git-upload-pack doesn't recognize text/plain error. Send an error
 	// with ErrorPacket.
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
-	if r.Header.Get("Content-Encoding") == "gzip" {
-		var err error
-		if r.Body, err = gzip.NewReader(r.Body); err != nil {
-			reporter.reportError(status.Errorf(codes.InvalidArgument, "cannot ungzip: %v", err))
-			return
-		}
+	if !ungzipRequestBody(reporter, r) {
+		return
 	}
 
 	// HTTP is strictly speaking a request-response protocol, and a server
@@ -106,12 +239,13 @@ func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.
 	// We need to compromise and either drain the entire request first or
 	// buffer the entire response.
 	//
-	// Because this server supports only ls-refs and fetch commands, valid
-	// protocol V2 requests are relatively small in practice compared to the
-	// response. A request with many wants and haves can be large, but
-	// practically there's a limit on the number of haves a client would
-	// send. Compared to that the fetch response can contain a packfile, and
-	// this can easily get large. Read the entire request upfront.
+	// Because this server supports only ls-refs, fetch, and bundle-uri
+	// commands, valid protocol V2 requests are relatively small in practice
+	// compared to the response. A request with many wants and haves can be
+	// large, but practically there's a limit on the number of haves a client
+	// would send. Compared to that the fetch response can contain a
+	// packfile, and this can easily get large. Read the entire request
+	// upfront.
 	commands, err := parseAllCommands(r.Body)
 	if err != nil {
 		reporter.reportError(err)
@@ -123,15 +257,59 @@ func (s *httpProxyServer) uploadPackHandler(reporter *httpErrorReporter, w http.
 		reporter.reportError(err)
 		return
 	}
+	if err := repo.waitForRestore(r.Context()); err != nil {
+		reporter.reportError(err)
+		return
+	}
 
 	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+	clientURL := clientRepositoryURL(r)
 	for _, command := range commands {
-		if !handleV2Command(r.Context(), gitReporter, repo, command, w) {
+		if !handleV2Command(r.Context(), gitReporter, repo, clientURL, command, w) {
 			return
 		}
 	}
 }
 
+func (s *httpProxyServer) uploadPackV1Handler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
+	if !ungzipRequestBody(reporter, r) {
+		return
+	}
+
+	// Protocol v0/v1 requests contain only wants and haves. Like the
+	// protocol v2 requests, read the entire request upfront.
+	request, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		reporter.reportError(status.Errorf(codes.InvalidArgument, "cannot read the request: %v", err))
+		return
+	}
+
+	repo, err := openManagedRepository(s.config, r.URL)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	if err := repo.waitForRestore(r.Context()); err != nil {
+		reporter.reportError(err)
+		return
+	}
+
+	gitReporter := &gitProtocolHTTPErrorReporter{config: s.config, req: r, w: w}
+	handleV1UploadPack(r.Context(), gitReporter, repo, request, w)
+}
+
+func ungzipRequestBody(reporter *httpErrorReporter, r *http.Request) bool {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var err error
+		if r.Body, err = gzip.NewReader(r.Body); err != nil {
+			reporter.reportError(status.Errorf(codes.InvalidArgument, "cannot ungzip: %v", err))
+			return false
+		}
+	}
+	return true
+}
+
 func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, error) {
 	commands := [][]*gitprotocolio.ProtocolV2RequestChunk{}
 	v2Req := gitprotocolio.NewProtocolV2Request(r)
@@ -151,6 +329,7 @@ func parseAllCommands(r io.Reader) ([][]*gitprotocolio.ProtocolV2RequestChunk, e
 		switch chunks[0].Command {
 		case "ls-refs":
 		case "fetch":
+		case "bundle-uri":
 			// Do nothing.
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "unrecognized command: %v", chunks[0])
@@ -0,0 +1,168 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+func lsRefsCommand(args ...string) []*gitprotocolio.ProtocolV2RequestChunk {
+	command := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{Capability: "agent=git/2.39.5"},
+		{EndCapability: true},
+	}
+	for _, arg := range args {
+		command = append(command, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(arg + "\n")})
+	}
+	return append(command, &gitprotocolio.ProtocolV2RequestChunk{EndRequest: true})
+}
+
+func lsRefsResponse(s string) []*gitprotocolio.ProtocolV2ResponseChunk {
+	return []*gitprotocolio.ProtocolV2ResponseChunk{
+		{Response: []byte(s)},
+		{EndResponse: true},
+	}
+}
+
+func cachedResponse(r *managedRepository, command []*gitprotocolio.ProtocolV2RequestChunk) string {
+	resp, ok := r.getCachedLsRefs(command)
+	if !ok {
+		return ""
+	}
+	return string(resp[0].Response)
+}
+
+func TestLsRefsCache_Expiry(t *testing.T) {
+	ttl := time.Minute
+	r := &managedRepository{config: &ServerConfig{LsRefsCacheTTL: ttl}}
+	command := lsRefsCommand("ref-prefix refs/heads/")
+
+	tests := []struct {
+		name string
+		age  time.Duration
+		want string
+	}{
+		{"fresh", 0, "fresh"},
+		{"before the TTL", ttl - 10*time.Second, "before the TTL"},
+		{"after the TTL", ttl + time.Second, ""},
+	}
+	for _, tc := range tests {
+		r.putCachedLsRefs(command, lsRefsResponse(tc.name), time.Now().Add(-tc.age), r.lsRefsCacheGeneration())
+		if got := cachedResponse(r, command); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLsRefsCache_KeyedByArguments(t *testing.T) {
+	r := &managedRepository{config: &ServerConfig{LsRefsCacheTTL: time.Minute}}
+	gen := r.lsRefsCacheGeneration()
+	now := time.Now()
+	r.putCachedLsRefs(lsRefsCommand("ref-prefix refs/heads/"), lsRefsResponse("heads"), now, gen)
+	r.putCachedLsRefs(lsRefsCommand("symrefs", "ref-prefix refs/heads/"), lsRefsResponse("symrefs"), now, gen)
+
+	tests := []struct {
+		name    string
+		command []*gitprotocolio.ProtocolV2RequestChunk
+		want    string
+	}{
+		{"ref-prefix", lsRefsCommand("ref-prefix refs/heads/"), "heads"},
+		{"symrefs", lsRefsCommand("symrefs", "ref-prefix refs/heads/"), "symrefs"},
+		{"reordered", lsRefsCommand("ref-prefix refs/heads/", "symrefs"), "symrefs"},
+		{"other prefix", lsRefsCommand("ref-prefix refs/tags/"), ""},
+		{"no arguments", lsRefsCommand(), ""},
+		{"peel", lsRefsCommand("peel", "ref-prefix refs/heads/"), ""},
+	}
+	for _, tc := range tests {
+		if got := cachedResponse(r, tc.command); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLsRefsCache_ZeroTTL(t *testing.T) {
+	r := &managedRepository{config: &ServerConfig{}}
+	command := lsRefsCommand("ref-prefix refs/heads/")
+	r.putCachedLsRefs(command, lsRefsResponse("heads"), time.Now(), r.lsRefsCacheGeneration())
+	if _, ok := r.getCachedLsRefs(command); ok {
+		t.Error("got a cached response with the TTL 0")
+	}
+	if r.lsRefsCache != nil {
+		t.Errorf("got cache entries %v with the TTL 0, want none", r.lsRefsCache)
+	}
+}
+
+func TestLsRefsCache_Invalidate(t *testing.T) {
+	r := &managedRepository{config: &ServerConfig{LsRefsCacheTTL: time.Minute}}
+	command := lsRefsCommand("ref-prefix refs/heads/")
+	r.putCachedLsRefs(command, lsRefsResponse("heads"), time.Now(), r.lsRefsCacheGeneration())
+
+	// A response obtained before the invalidation is not stored.
+	gen := r.lsRefsCacheGeneration()
+	r.invalidateLsRefsCache()
+	if got := cachedResponse(r, command); got != "" {
+		t.Errorf("got %q after the invalidation, want no cache", got)
+	}
+	r.putCachedLsRefs(command, lsRefsResponse("stale"), time.Now(), gen)
+	if got := cachedResponse(r, command); got != "" {
+		t.Errorf("got %q stored with an old generation, want no cache", got)
+	}
+	r.putCachedLsRefs(command, lsRefsResponse("new"), time.Now(), r.lsRefsCacheGeneration())
+	if got := cachedResponse(r, command); got != "new" {
+		t.Errorf("got %q, want new", got)
+	}
+}
+
+func TestLsRefsCache_InvalidatedByFetchUpstream(t *testing.T) {
+	upstream, cleanupUpstream := newMaintenanceTestRepository(t, 1)
+	defer cleanupUpstream()
+	dir, err := ioutil.TempDir("", "goblet_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gitCommand(t, dir, "init", "--bare", "-q")
+	gitCommand(t, dir, "remote", "add", "origin", upstream.localDiskPath)
+
+	r := &managedRepository{
+		localDiskPath: dir,
+		upstreamURL:   &url.URL{Scheme: "file", Path: upstream.localDiskPath},
+		config: &ServerConfig{
+			LsRefsCacheTTL:     time.Minute,
+			CredentialProvider: NewStaticCredentialProvider(nil),
+		},
+	}
+	command := lsRefsCommand("ref-prefix refs/heads/")
+	r.putCachedLsRefs(command, lsRefsResponse("heads"), time.Now(), r.lsRefsCacheGeneration())
+
+	if err := r.fetchUpstream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedResponse(r, command); got != "" {
+		t.Errorf("got %q after the refs update, want no cache", got)
+	}
+	want := gitCommand(t, upstream.localDiskPath, "rev-parse", "refs/heads/main")
+	if got := gitCommand(t, dir, "rev-parse", "refs/heads/main"); got != want {
+		t.Errorf("got refs/heads/main %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceTask is a repository maintenance operation.
+type MaintenanceTask string
+
+const (
+	// MaintenanceGC runs git-gc. It blocks the requests to the repository
+	// while it runs, as it deletes the packfiles they may be reading.
+	MaintenanceGC MaintenanceTask = "gc"
+
+	// MaintenanceRepack repacks all objects into one pack with a bitmap
+	// index. The old packs are deleted after the requests that may be
+	// reading them finish.
+	MaintenanceRepack MaintenanceTask = "repack"
+
+	// MaintenanceCommitGraph writes the commit-graph file.
+	MaintenanceCommitGraph MaintenanceTask = "commit-graph"
+
+	// MaintenanceMultiPackIndex writes the multi-pack-index file.
+	MaintenanceMultiPackIndex MaintenanceTask = "multi-pack-index"
+
+	// MaintenancePackRefs packs the loose refs.
+	MaintenancePackRefs MaintenanceTask = "pack-refs"
+)
+
+var (
+	maintenanceTaskArgs = map[MaintenanceTask][]string{
+		MaintenanceGC:             {"gc", "--quiet"},
+		MaintenanceRepack:         {"repack", "-a", "-q", "--write-bitmap-index"},
+		MaintenanceCommitGraph:    {"commit-graph", "write", "--reachable"},
+		MaintenanceMultiPackIndex: {"multi-pack-index", "write"},
+		MaintenancePackRefs:       {"pack-refs", "--all"},
+	}
+
+	// exclusiveMaintenanceTasks are the tasks that block the requests to
+	// the repository while they run, as they can delete the packfiles
+	// being read.
+	exclusiveMaintenanceTasks = map[MaintenanceTask]bool{
+		MaintenanceGC: true,
+	}
+
+	// DefaultMaintenanceTasks is used when ServerConfig.MaintenanceTasks
+	// is empty.
+	DefaultMaintenanceTasks = []MaintenanceTask{
+		MaintenancePackRefs,
+		MaintenanceRepack,
+		MaintenanceCommitGraph,
+	}
+)
+
+// ParseMaintenanceTask returns the MaintenanceTask with the name.
+func ParseMaintenanceTask(name string) (MaintenanceTask, error) {
+	t := MaintenanceTask(name)
+	if _, ok := maintenanceTaskArgs[t]; !ok {
+		return "", fmt.Errorf("unknown maintenance task: %s", name)
+	}
+	return t, nil
+}
+
+// RunMaintenanceProcess starts running the maintenance tasks for the managed
+// repositories every ServerConfig.MaintenanceInterval.
+func RunMaintenanceProcess(config *ServerConfig) {
+	runMaintenanceProcess(config, nil)
+}
+
+// runMaintenanceProcess is RunMaintenanceProcess that stops when stop is
+// closed.
+func runMaintenanceProcess(config *ServerConfig, stop <-chan struct{}) {
+	if config.MaintenanceInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.MaintenanceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			ListManagedRepositories(func(m ManagedRepository) {
+				// Errors are reported via
+				// LongRunningOperationLogger.
+				m.(*managedRepository).runMaintenance(false)
+			})
+		}
+	}()
+}
+
+// RunMaintenance runs the maintenance tasks for the repository.
+func (r *managedRepository) RunMaintenance() error {
+	return r.runMaintenance(true)
+}
+
+func (r *managedRepository) runMaintenance(force bool) (err error) {
+	// The tasks other than exclusiveMaintenanceTasks run while the
+	// requests are served. They only add files or replace them with a
+	// rename, except that the repack leaves the packfiles it replaced.
+	// Those are deleted by pruneRedundantPacks once the readers that may
+	// have opened them are done.
+	r.maintenanceMu.Lock()
+	defer r.maintenanceMu.Unlock()
+	if t := atomic.LoadInt64(&r.lastMaintenance); !force && t != 0 && !r.LastUpdateTime().After(time.Unix(0, t)) {
+		// Nothing has changed since the last maintenance.
+		return nil
+	}
+
+	op := r.startOperation("Maintenance")
+	defer func() {
+		op.Done(err)
+	}()
+
+	tasks := r.config.MaintenanceTasks
+	if len(tasks) == 0 {
+		tasks = DefaultMaintenanceTasks
+	}
+	startTime := time.Now()
+	for _, task := range tasks {
+		if _, ok := maintenanceTaskArgs[task]; !ok {
+			err = fmt.Errorf("unknown maintenance task: %s", task)
+			return
+		}
+		op.Printf("Running %s\n", task)
+		if err = r.runMaintenanceTask(op, task); err != nil {
+			if err != errRepositoryEvicted {
+				err = fmt.Errorf("maintenance task %s failed: %v", task, err)
+			}
+			return
+		}
+	}
+	atomic.StoreInt64(&r.lastMaintenance, startTime.UnixNano())
+	return
+}
+
+func (r *managedRepository) runMaintenanceTask(op RunningOperation, task MaintenanceTask) error {
+	if exclusiveMaintenanceTasks[task] {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+	} else {
+		defer r.readLock()()
+	}
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+
+	switch task {
+	case MaintenanceRepack:
+		return r.repack(op)
+	case MaintenancePackRefs:
+		// The fetch updates the refs while holding refsMu.
+		r.refsMu.Lock()
+		defer r.refsMu.Unlock()
+	}
+	return runGit(op, r.localDiskPath, maintenanceTaskArgs[task]...)
+}
+
+// readLock acquires mu for reading and registers the caller as a reader of
+// the current packfiles. The returned function releases them.
+func (r *managedRepository) readLock() func() {
+	r.mu.RLock()
+	r.packsMu.Lock()
+	gen := r.packGen
+	if r.packReaders == nil {
+		r.packReaders = map[uint64]int{}
+	}
+	r.packReaders[gen]++
+	r.packsMu.Unlock()
+	return func() {
+		r.packsMu.Lock()
+		if r.packReaders[gen]--; r.packReaders[gen] == 0 {
+			delete(r.packReaders, gen)
+		}
+		r.packsMu.Unlock()
+		r.pruneRedundantPacks()
+		r.mu.RUnlock()
+	}
+}
+
+// repack repacks all objects into a new packfile without deleting the old
+// ones. The old ones are marked as redundant, and pruneRedundantPacks
+// deletes them later.
+func (r *managedRepository) repack(op RunningOperation) error {
+	r.packsMu.Lock()
+	pending := len(r.redundantPacks) != 0
+	r.packsMu.Unlock()
+	if pending {
+		op.Printf("Skipping repack as the packfiles replaced by the last one are still in use\n")
+		return nil
+	}
+
+	before, err := r.listPacks()
+	if err != nil {
+		return err
+	}
+	if err := runGit(op, r.localDiskPath, maintenanceTaskArgs[MaintenanceRepack]...); err != nil {
+		return err
+	}
+	after, err := r.listPacks()
+	if err != nil {
+		return err
+	}
+	added := 0
+	for pack := range after {
+		if !before[pack] {
+			added++
+		}
+	}
+	if added != 1 {
+		// Either nothing was repacked, or a fetch has added a
+		// packfile concurrently. Leave the old ones to the next
+		// repack as it's not clear which one has all objects.
+		return nil
+	}
+	redundant := []string{}
+	for pack := range before {
+		if after[pack] {
+			redundant = append(redundant, pack)
+		}
+	}
+	sort.Strings(redundant)
+
+	// The readers that start from now on prefer the new packfile as git
+	// looks up the objects in the newest packfile first.
+	r.packsMu.Lock()
+	r.redundantPacks = redundant
+	r.redundantPackGen = r.packGen
+	r.packGen++
+	r.packsMu.Unlock()
+	return nil
+}
+
+// listPacks returns the names of the packfiles without the extension. The
+// packfiles with a .keep file are excluded as repack doesn't replace them.
+func (r *managedRepository) listPacks() (map[string]bool, error) {
+	paths, err := filepath.Glob(filepath.Join(r.localDiskPath, "objects", "pack", "pack-*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	packs := map[string]bool{}
+	for _, p := range paths {
+		pack := strings.TrimSuffix(p, ".pack")
+		if _, err := os.Stat(pack + ".keep"); err == nil {
+			continue
+		}
+		packs[pack] = true
+	}
+	return packs, nil
+}
+
+// pruneRedundantPacks deletes the packfiles replaced by the last repack if
+// no reader that started before the repack remains. It also deletes the
+// loose objects that have been packed. The caller must hold mu.
+func (r *managedRepository) pruneRedundantPacks() {
+	r.packsMu.Lock()
+	defer r.packsMu.Unlock()
+	if len(r.redundantPacks) == 0 {
+		return
+	}
+	for gen := range r.packReaders {
+		if gen <= r.redundantPackGen {
+			return
+		}
+	}
+	packs := r.redundantPacks
+	r.redundantPacks = nil
+
+	var err error
+	op := r.startOperation("PruneRedundantPacks")
+	defer func() {
+		op.Done(err)
+	}()
+	if _, statErr := os.Stat(filepath.Join(r.localDiskPath, "objects", "pack", "multi-pack-index")); statErr == nil {
+		// Rewrite the multi-pack-index first so that it doesn't refer
+		// to the deleted packfiles.
+		var remaining []string
+		if remaining, err = r.remainingPackIndexes(packs); err != nil {
+			return
+		}
+		stdin := strings.NewReader(strings.Join(remaining, "\n") + "\n")
+		if err = runGitWithStdInOut(op, stdin, ioutil.Discard, r.localDiskPath, "multi-pack-index", "write", "--stdin-packs"); err != nil {
+			return
+		}
+	}
+	for _, pack := range packs {
+		// Remove the index first as git recognizes a packfile by it.
+		if err = removeIfExists(pack + ".idx"); err != nil {
+			return
+		}
+		var paths []string
+		if paths, err = filepath.Glob(pack + ".*"); err != nil {
+			return
+		}
+		for _, p := range paths {
+			if err = removeIfExists(p); err != nil {
+				return
+			}
+		}
+	}
+	err = runGit(op, r.localDiskPath, "prune-packed", "-q")
+}
+
+// remainingPackIndexes returns the base names of the pack indexes except the
+// ones of the packs.
+func (r *managedRepository) remainingPackIndexes(packs []string) ([]string, error) {
+	deleted := map[string]bool{}
+	for _, pack := range packs {
+		deleted[pack] = true
+	}
+	paths, err := filepath.Glob(filepath.Join(r.localDiskPath, "objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, p := range paths {
+		if !deleted[strings.TrimSuffix(p, ".idx")] {
+			ret = append(ret, filepath.Base(p))
+		}
+	}
+	return ret, nil
+}
+
+func removeIfExists(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
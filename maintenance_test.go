@@ -0,0 +1,200 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func gitCommand(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=goblet", "-c", "user.email=goblet@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newMaintenanceTestRepository returns a bare repository that has a commit
+// in each of the n packfiles.
+func newMaintenanceTestRepository(t *testing.T, n int, tasks ...MaintenanceTask) (*managedRepository, func()) {
+	dir, err := ioutil.TempDir("", "goblet_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitCommand(t, dir, "init", "--bare", "-q")
+	tree := gitCommand(t, dir, "mktree")
+	parent := []string{}
+	for i := 0; i < n; i++ {
+		commit := gitCommand(t, dir, append([]string{"commit-tree", tree, "-m", "test"}, parent...)...)
+		gitCommand(t, dir, "update-ref", "refs/heads/main", commit)
+		gitCommand(t, dir, "repack", "-q")
+		parent = []string{"-p", commit}
+	}
+	r := &managedRepository{
+		localDiskPath: dir,
+		config:        &ServerConfig{MaintenanceTasks: tasks},
+	}
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func mustListPacks(t *testing.T, r *managedRepository) map[string]bool {
+	t.Helper()
+	packs, err := r.listPacks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packs
+}
+
+func TestRunMaintenance_KeepsPacksInUse(t *testing.T) {
+	r, cleanup := newMaintenanceTestRepository(t, 2, MaintenanceRepack)
+	defer cleanup()
+	before := mustListPacks(t, r)
+	if len(before) != 2 {
+		t.Fatalf("got %d packfiles, want 2", len(before))
+	}
+
+	unlock := r.readLock()
+	if err := r.RunMaintenance(); err != nil {
+		unlock()
+		t.Fatal(err)
+	}
+	if got := mustListPacks(t, r); len(got) != 3 {
+		t.Errorf("got %d packfiles while the old ones are in use, want 3", len(got))
+	}
+
+	// The readers that start after the repack don't keep the old
+	// packfiles.
+	unlockAfterRepack := r.readLock()
+	unlock()
+	after := mustListPacks(t, r)
+	unlockAfterRepack()
+	if len(after) != 1 {
+		t.Fatalf("got %d packfiles after the readers are done, want 1", len(after))
+	}
+	for pack := range after {
+		if before[pack] {
+			t.Errorf("got the old packfile %s, want the new one", pack)
+		}
+	}
+	gitCommand(t, r.localDiskPath, "rev-list", "--objects", "refs/heads/main")
+
+	// Nothing is left to delete.
+	if err := r.RunMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustListPacks(t, r); len(got) != 1 {
+		t.Errorf("got %d packfiles after repacking one, want 1", len(got))
+	}
+}
+
+func TestRunMaintenance_MultiPackIndex(t *testing.T) {
+	r, cleanup := newMaintenanceTestRepository(t, 2, MaintenanceMultiPackIndex, MaintenanceRepack, MaintenanceMultiPackIndex)
+	defer cleanup()
+
+	if err := r.RunMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if got := mustListPacks(t, r); len(got) != 1 {
+		t.Errorf("got %d packfiles, want 1", len(got))
+	}
+	gitCommand(t, r.localDiskPath, "multi-pack-index", "verify")
+	gitCommand(t, r.localDiskPath, "rev-list", "--objects", "refs/heads/main")
+}
+
+func TestRunMaintenance_SkipIfNotUpdated(t *testing.T) {
+	r, cleanup := newMaintenanceTestRepository(t, 1, MaintenancePackRefs)
+	defer cleanup()
+
+	if err := r.runMaintenance(false); err != nil {
+		t.Fatal(err)
+	}
+	first := atomic.LoadInt64(&r.lastMaintenance)
+	if first == 0 {
+		t.Fatal("got no maintenance for a repository that has never been maintained")
+	}
+
+	if err := r.runMaintenance(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&r.lastMaintenance); got != first {
+		t.Error("got a maintenance for a repository that hasn't been updated")
+	}
+
+	atomic.StoreInt64(&r.lastUpdate, time.Now().UnixNano())
+	if err := r.runMaintenance(false); err != nil {
+		t.Fatal(err)
+	}
+	second := atomic.LoadInt64(&r.lastMaintenance)
+	if second == first {
+		t.Error("got no maintenance for an updated repository")
+	}
+
+	// RunMaintenance doesn't skip.
+	if err := r.RunMaintenance(); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&r.lastMaintenance); got == second {
+		t.Error("got no maintenance by RunMaintenance")
+	}
+}
+
+func TestRunMaintenanceProcess(t *testing.T) {
+	r, cleanup := newMaintenanceTestRepository(t, 2, MaintenanceRepack)
+	defer cleanup()
+	managedRepos.Store(r.localDiskPath, r)
+	defer managedRepos.Delete(r.localDiskPath)
+
+	waitForMaintenance := func(after int64) int64 {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			if got := atomic.LoadInt64(&r.lastMaintenance); got != after {
+				return got
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("got no maintenance")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	config := &ServerConfig{MaintenanceInterval: 20 * time.Millisecond}
+	stop := make(chan struct{})
+	defer close(stop)
+	runMaintenanceProcess(config, stop)
+
+	first := waitForMaintenance(0)
+	if got := mustListPacks(t, r); len(got) != 1 {
+		t.Errorf("got %d packfiles after the maintenance, want 1", len(got))
+	}
+
+	// The repository isn't maintained again until it's updated.
+	time.Sleep(5 * config.MaintenanceInterval)
+	if got := atomic.LoadInt64(&r.lastMaintenance); got != first {
+		t.Error("got a maintenance for a repository that hasn't been updated")
+	}
+	atomic.StoreInt64(&r.lastUpdate, time.Now().UnixNano())
+	waitForMaintenance(first)
+}
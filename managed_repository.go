@@ -26,8 +26,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -35,7 +37,7 @@ import (
 	"github.com/google/gitprotocolio"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
-	"golang.org/x/oauth2"
+	"go.opencensus.io/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -46,6 +48,15 @@ var (
 	managedRepos sync.Map
 )
 
+const (
+	// fetchStagingRefPrefix is the namespace where the upstream fetch
+	// writes the refs before the refs themselves are updated. It's hidden
+	// from the clients.
+	fetchStagingRefPrefix = "refs/goblet-fetch/"
+
+	hideStagingRefsConfig = "uploadpack.hideRefs=refs/goblet-fetch"
+)
+
 func init() {
 	var err error
 	gitBinary, err = exec.LookPath("git")
@@ -65,6 +76,7 @@ func getManagedRepo(localDiskPath string, u *url.URL, config *ServerConfig) *man
 	ret := m.(*managedRepository)
 	if !loaded {
 		ret.mu.Unlock()
+		addGauge(ManagedRepositoryCount, &managedRepositoryCount, 1)
 	}
 	return ret
 }
@@ -77,16 +89,42 @@ func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository
 
 	localDiskPath := filepath.Join(config.LocalDiskCacheRoot, u.Host, u.Path)
 
-	m := getManagedRepo(localDiskPath, u, config)
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	var m *managedRepository
+	for {
+		m = getManagedRepo(localDiskPath, u, config)
+		// Usually the repository already exists. Check it with the
+		// read lock so that the request doesn't wait for the in-flight
+		// requests to the repository.
+		m.mu.RLock()
+		evicted := m.evicted
+		_, statErr := os.Stat(localDiskPath)
+		m.mu.RUnlock()
+		if evicted {
+			continue
+		}
+		if statErr == nil {
+			m.touch()
+			return m, nil
+		}
+
+		m.mu.Lock()
+		if !m.evicted {
+			break
+		}
+		// The repository has been evicted while waiting for the
+		// lock. Retry with a new one.
+		m.mu.Unlock()
+	}
+	m.touch()
 
 	if _, err := os.Stat(localDiskPath); err != nil {
 		if !os.IsNotExist(err) {
+			m.mu.Unlock()
 			return nil, status.Errorf(codes.Internal, "error while initializing local Git repoitory: %v", err)
 		}
 
 		if err := os.MkdirAll(localDiskPath, 0750); err != nil {
+			m.mu.Unlock()
 			return nil, status.Errorf(codes.Internal, "cannot create a cache dir: %v", err)
 		}
 
@@ -99,7 +137,17 @@ func openManagedRepository(config *ServerConfig, u *url.URL) (*managedRepository
 		// It seems there's a bug in libcurl and HTTP/2 doens't work.
 		runGit(op, localDiskPath, "config", "http.version", "HTTP/1.1")
 		runGit(op, localDiskPath, "remote", "add", "--mirror=fetch", "origin", u.String())
+
+		if config.RepositoryRestorer != nil {
+			// Mark the restore before releasing the lock so that
+			// the other requests wait for it.
+			m.beginRestore()
+			m.mu.Unlock()
+			m.restoreRepository()
+			return m, nil
+		}
 	}
+	m.mu.Unlock()
 
 	return m, nil
 }
@@ -121,31 +169,280 @@ func logStats(command string, startTime time.Time, err error) {
 
 type managedRepository struct {
 	localDiskPath string
-	lastUpdate    time.Time
-	upstreamURL   *url.URL
-	config        *ServerConfig
-	mu            sync.RWMutex
+	// lastUpdate is a UNIX time in nanoseconds when the upstream fetch
+	// started last time. Accessed atomically.
+	lastUpdate int64
+	// lastMaintenance is a UNIX time in nanoseconds when the last
+	// maintenance started. Accessed atomically.
+	lastMaintenance int64
+	upstreamURL     *url.URL
+	config          *ServerConfig
+	// mu is held for reading while the objects in the repository are read
+	// or added, such as serving a fetch, creating a bundle, fetching from
+	// the upstream, and most maintenance tasks. It's held for writing
+	// while the objects can be removed, such as git-gc, the bundle
+	// recovery, and the eviction, so that an in-flight git-upload-pack
+	// never loses the packfiles it's reading. Use readLock to hold it for
+	// reading.
+	mu sync.RWMutex
+	// maintenanceMu serializes the maintenance.
+	maintenanceMu sync.Mutex
+	// packsMu guards the packfiles replaced by the last repack and the
+	// readers counted per packGen, which is bumped by a repack. The
+	// replaced packfiles are deleted when no reader of redundantPackGen
+	// or before remains.
+	packsMu          sync.Mutex
+	packGen          uint64
+	packReaders      map[uint64]int
+	redundantPacks   []string
+	redundantPackGen uint64
+	// refsMu is held for writing while the upstream fetch updates the
+	// refs, and for reading while a response has to be made from one
+	// state of the refs. If both are held, mu is acquired first. The
+	// operations that hold mu for writing don't need it.
+	refsMu sync.RWMutex
+	// evicted is true if the repository is removed from the disk. Guarded
+	// by mu.
+	evicted bool
+	// lastAccess is a UNIX time in nanoseconds when the repository is
+	// opened last time. Accessed atomically.
+	lastAccess int64
+
+	lsRefsCacheMu  sync.Mutex
+	lsRefsCache    map[string]*lsRefsCacheEntry
+	lsRefsCacheGen uint64
+
+	fetchMu      sync.Mutex
+	runningFetch *upstreamFetch
+	queuedFetch  *upstreamFetch
+
+	refsUpdateMu sync.Mutex
+	refsUpdate   chan struct{}
+
+	// upstreamRefs has the refs that the upstream advertised with the
+	// hashes different from the local ones. An entry is removed when a
+	// fetch started after the advertisement finishes.
+	upstreamRefsMu sync.Mutex
+	upstreamRefs   map[string]*advertisedRef
+
+	progressMu          sync.Mutex
+	progressSubscribers map[chan string]bool
+
+	opsMu      sync.Mutex
+	runningOps map[*trackedOperation]bool
+	lastError  *OperationError
+
+	restoreMu    sync.Mutex
+	restoreState int
+	restoreDone  chan struct{}
+
+	uriBundleJob   backgroundJob
+	packfileURIJob backgroundJob
+}
+
+// subscribeFetchProgress returns a channel that receives the progress
+// messages of the upstream fetch. The returned function must be called to
+// unsubscribe.
+func (r *managedRepository) subscribeFetchProgress() (<-chan string, func()) {
+	ch := make(chan string, 16)
+	r.progressMu.Lock()
+	defer r.progressMu.Unlock()
+	if r.progressSubscribers == nil {
+		r.progressSubscribers = map[chan string]bool{}
+	}
+	r.progressSubscribers[ch] = true
+	return ch, func() {
+		r.progressMu.Lock()
+		defer r.progressMu.Unlock()
+		delete(r.progressSubscribers, ch)
+	}
+}
+
+func (r *managedRepository) publishFetchProgress(msg string) {
+	r.progressMu.Lock()
+	defer r.progressMu.Unlock()
+	for ch := range r.progressSubscribers {
+		select {
+		case ch <- msg:
+		default:
+			// Progress messages are best-effort. Do not block
+			// the fetch for a slow client.
+		}
+	}
+}
+
+// refsUpdateNotifier returns a channel that is closed when the refs are
+// updated next time.
+func (r *managedRepository) refsUpdateNotifier() <-chan struct{} {
+	r.refsUpdateMu.Lock()
+	defer r.refsUpdateMu.Unlock()
+	if r.refsUpdate == nil {
+		r.refsUpdate = make(chan struct{})
+	}
+	return r.refsUpdate
+}
+
+// notifyRefsUpdate wakes up all the goroutines waiting for the refs update.
+func (r *managedRepository) notifyRefsUpdate() {
+	r.refsUpdateMu.Lock()
+	defer r.refsUpdateMu.Unlock()
+	if r.refsUpdate != nil {
+		close(r.refsUpdate)
+		r.refsUpdate = nil
+	}
+}
+
+type advertisedRef struct {
+	hash          plumbing.Hash
+	advertiseTime time.Time
+}
+
+// upstreamFetch is a fetchUpstream invocation shared by multiple requests.
+type upstreamFetch struct {
+	done chan struct{}
+	err  error
+	// spanContext is the span of the fetch. Set before done is closed.
+	spanContext trace.SpanContext
+}
+
+func newUpstreamFetch() *upstreamFetch {
+	return &upstreamFetch{done: make(chan struct{})}
+}
+
+// requestFetchUpstream schedules fetchUpstream and returns the fetch that
+// covers the request. The returned fetch's done channel is closed when it
+// finishes.
+//
+// At most one fetch runs at a time. If a fetch is already running, it might
+// have started before the caller observed the missing objects, so a
+// follow-up fetch is queued. All the requests made while a fetch is running
+// share the same follow-up fetch.
+func (r *managedRepository) requestFetchUpstream() *upstreamFetch {
+	r.fetchMu.Lock()
+	defer r.fetchMu.Unlock()
+	if r.runningFetch == nil {
+		r.runningFetch = newUpstreamFetch()
+		go r.runFetches(r.runningFetch)
+		return r.runningFetch
+	}
+	if r.queuedFetch == nil {
+		r.queuedFetch = newUpstreamFetch()
+	}
+	return r.queuedFetch
+}
+
+func (r *managedRepository) runFetches(f *upstreamFetch) {
+	for f != nil {
+		addGauge(UpstreamFetchInFlightCount, &upstreamFetchInFlightCount, 1)
+		ctx, span := trace.StartSpan(context.Background(), "goblet/fetch-upstream")
+		span.AddAttributes(trace.StringAttribute("goblet.upstream_url", r.upstreamURL.String()))
+		f.spanContext = span.SpanContext()
+		f.err = r.fetchUpstream(ctx)
+		endSpan(span, f.err)
+		addGauge(UpstreamFetchInFlightCount, &upstreamFetchInFlightCount, -1)
+		close(f.done)
+
+		r.fetchMu.Lock()
+		f, r.queuedFetch = r.queuedFetch, nil
+		r.runningFetch = f
+		r.fetchMu.Unlock()
+	}
+}
+
+type lsRefsCacheEntry struct {
+	resp      []*gitprotocolio.ProtocolV2ResponseChunk
+	fetchTime time.Time
+}
+
+func (r *managedRepository) getCachedLsRefs(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, bool) {
+	if r.config.LsRefsCacheTTL <= 0 {
+		return nil, false
+	}
+	r.lsRefsCacheMu.Lock()
+	defer r.lsRefsCacheMu.Unlock()
+	e, ok := r.lsRefsCache[lsRefsCacheKey(command)]
+	if !ok || time.Since(e.fetchTime) > r.config.LsRefsCacheTTL {
+		return nil, false
+	}
+	return e.resp, true
+}
+
+// lsRefsCacheGeneration returns a number that changes every time the cache is
+// invalidated. This is used to avoid storing a response that was obtained
+// before the invalidation.
+func (r *managedRepository) lsRefsCacheGeneration() uint64 {
+	r.lsRefsCacheMu.Lock()
+	defer r.lsRefsCacheMu.Unlock()
+	return r.lsRefsCacheGen
+}
+
+func (r *managedRepository) putCachedLsRefs(command []*gitprotocolio.ProtocolV2RequestChunk, resp []*gitprotocolio.ProtocolV2ResponseChunk, fetchTime time.Time, gen uint64) {
+	if r.config.LsRefsCacheTTL <= 0 {
+		return
+	}
+	r.lsRefsCacheMu.Lock()
+	defer r.lsRefsCacheMu.Unlock()
+	if r.lsRefsCacheGen != gen {
+		return
+	}
+	if r.lsRefsCache == nil {
+		r.lsRefsCache = map[string]*lsRefsCacheEntry{}
+	}
+	r.lsRefsCache[lsRefsCacheKey(command)] = &lsRefsCacheEntry{resp: resp, fetchTime: fetchTime}
+}
+
+func (r *managedRepository) invalidateLsRefsCache() {
+	r.lsRefsCacheMu.Lock()
+	defer r.lsRefsCacheMu.Unlock()
+	r.lsRefsCache = nil
+	r.lsRefsCacheGen++
+}
+
+// lsRefsCacheKey returns a key that identifies the ls-refs arguments. The
+// capabilities such as agent are not a part of the key as they do not change
+// the response.
+func lsRefsCacheKey(command []*gitprotocolio.ProtocolV2RequestChunk) string {
+	args := []string{}
+	for _, c := range command {
+		if c.Argument == nil {
+			continue
+		}
+		args = append(args, strings.TrimSpace(string(c.Argument)))
+	}
+	sort.Strings(args)
+	return strings.Join(args, "\n")
 }
 
-func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+func (r *managedRepository) lsRefsUpstream(ctx context.Context, command []*gitprotocolio.ProtocolV2RequestChunk) (_ []*gitprotocolio.ProtocolV2ResponseChunk, err error) {
+	ctx, span := trace.StartSpan(ctx, "goblet/ls-refs-upstream")
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	req, err := http.NewRequest("POST", r.upstreamURL.String()+"/git-upload-pack", newGitRequest(command))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
 	}
-	t, err := r.config.TokenSource.Token()
+	req = req.WithContext(ctx)
+	c, err := r.upstreamCredential()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
+		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-git-upload-pack-request")
 	req.Header.Add("Accept", "application/x-git-upload-pack-result")
 	req.Header.Add("Git-Protocol", "version=2")
-	t.SetAuthHeader(req)
+	if h := c.AuthorizationHeader(); h != "" {
+		req.Header.Set("Authorization", h)
+	}
 
 	startTime := time.Now()
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := upstreamHTTPClient.Do(req)
 	logStats("ls-refs", startTime, err)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot send a request to the upstream: %v", err)
+		// Connection errors and timeouts are treated as the upstream
+		// being unavailable so that the caller can fall back to the
+		// local cache.
+		return nil, status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
@@ -156,6 +453,9 @@ func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2Re
 				errMessage = string(bs)
 			}
 		}
+		if resp.StatusCode >= 500 {
+			return nil, status.Errorf(codes.Unavailable, "got a non-OK response from the upstream: %v %s", resp.StatusCode, errMessage)
+		}
 		return nil, fmt.Errorf("got a non-OK response from the upstream: %v %s", resp.StatusCode, errMessage)
 	}
 
@@ -170,8 +470,27 @@ func (r *managedRepository) lsRefsUpstream(command []*gitprotocolio.ProtocolV2Re
 	return chunks, nil
 }
 
-func (r *managedRepository) fetchUpstream() (err error) {
-	op := r.startOperation("FetchUpstream")
+func (r *managedRepository) lsRefsLocal(command []*gitprotocolio.ProtocolV2RequestChunk) ([]*gitprotocolio.ProtocolV2ResponseChunk, error) {
+	// git-upload-pack handles ref-prefix, symrefs, and peel arguments in
+	// the same way as the upstream does.
+	b := new(bytes.Buffer)
+	if err := r.serveFetchLocal(command, b); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot run ls-refs on the local cached repository: %v", err)
+	}
+
+	chunks := []*gitprotocolio.ProtocolV2ResponseChunk{}
+	v2Resp := gitprotocolio.NewProtocolV2Response(b)
+	for v2Resp.Scan() {
+		chunks = append(chunks, copyResponseChunk(v2Resp.Chunk()))
+	}
+	if err := v2Resp.Err(); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot parse the local ls-refs response: %v", err)
+	}
+	return chunks, nil
+}
+
+func (r *managedRepository) fetchUpstream(ctx context.Context) (err error) {
+	op := &progressPublishingOperation{r.startOperation("FetchUpstream"), r}
 	defer func() {
 		op.Done(err)
 	}()
@@ -189,46 +508,128 @@ func (r *managedRepository) fetchUpstream() (err error) {
 		splitGitFetch = true
 	}
 
-	var t *oauth2.Token
 	startTime := time.Now()
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	// git-fetch only adds objects without the automatic gc, so the
+	// requests can be served while it's running. The requests that depend
+	// on the refs wait only for the refs update.
+	defer r.readLock()()
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+	defer scheduleCacheDiskQuotaCheck(r.config)
 	if splitGitFetch {
 		// Fetch heads and changes first.
-		t, err = r.config.TokenSource.Token()
-		if err != nil {
-			err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
-			return err
+		err = r.fetchAndUpdateRefs(ctx, op, "refs/heads/", "refs/changes/")
+		if err == nil {
+			// Waiting requests might be satisfied with the heads
+			// and changes.
+			r.notifyRefsUpdate()
 		}
-		err = runGit(op, r.localDiskPath, "-c", "http.extraHeader=Authorization: Bearer "+t.AccessToken, "fetch", "--progress", "-f", "-n", "origin", "refs/heads/*:refs/heads/*", "refs/changes/*:refs/changes/*")
 	}
 	if err == nil {
-		t, err = r.config.TokenSource.Token()
-		if err != nil {
-			err = status.Errorf(codes.Internal, "cannot obtain an OAuth2 access token for the server: %v", err)
-			return err
-		}
-		err = runGit(op, r.localDiskPath, "-c", "http.extraHeader=Authorization: Bearer "+t.AccessToken, "fetch", "--progress", "-f", "origin")
+		err = r.fetchAndUpdateRefs(ctx, op, "refs/")
 	}
 	logStats("fetch", startTime, err)
 	if err == nil {
-		r.lastUpdate = startTime
+		atomic.StoreInt64(&r.lastUpdate, startTime.UnixNano())
+		r.forgetUpstreamRefs(startTime)
 	}
+	r.invalidateLsRefsCache()
+	r.notifyRefsUpdate()
 	return err
 }
 
+// fetchAndUpdateRefs fetches the upstream refs under the prefixes in two
+// steps. git-fetch downloads the objects and writes the refs under
+// fetchStagingRefPrefix instead of the refs themselves. Then the refs are
+// updated to the staged ones with refsMu locked, without contacting the
+// upstream again.
+func (r *managedRepository) fetchAndUpdateRefs(ctx context.Context, op RunningOperation, prefixes ...string) error {
+	// The empty --refmap stops git-fetch from updating the refs with the
+	// configured mirror refspec.
+	args := []string{"--progress", "--no-tags", "--no-write-fetch-head", "--refmap=", "origin"}
+	for _, prefix := range prefixes {
+		args = append(args, "+"+prefix+"*:"+stagingRefName(prefix)+"*")
+	}
+	if err := r.runUpstreamFetch(ctx, op, args...); err != nil {
+		return err
+	}
+	r.refsMu.Lock()
+	defer r.refsMu.Unlock()
+	return r.updateRefsFromStaging(op)
+}
+
+// stagingRefName returns the name of the staged ref for the ref.
+func stagingRefName(name string) string {
+	return fetchStagingRefPrefix + strings.TrimPrefix(name, "refs/")
+}
+
+// updateRefsFromStaging updates the refs that are different from the staged
+// ones in one transaction. The staged refs are kept so that the next
+// git-fetch writes only the ones changed in the upstream.
+func (r *managedRepository) updateRefsFromStaging(op RunningOperation) error {
+	out := new(bytes.Buffer)
+	if err := runGitWithStdOut(op, out, r.localDiskPath, "for-each-ref", "--format=%(objectname) %(refname)"); err != nil {
+		return err
+	}
+	refs := map[string]string{}
+	staged := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		ss := strings.SplitN(line, " ", 2)
+		if len(ss) != 2 {
+			continue
+		}
+		refs[ss[1]] = ss[0]
+		if strings.HasPrefix(ss[1], fetchStagingRefPrefix) {
+			staged = append(staged, ss[1])
+		}
+	}
+
+	updates := new(bytes.Buffer)
+	for _, name := range staged {
+		target := "refs/" + strings.TrimPrefix(name, fetchStagingRefPrefix)
+		if refs[target] != refs[name] {
+			fmt.Fprintf(updates, "update %s %s\n", target, refs[name])
+		}
+	}
+	if updates.Len() == 0 {
+		return nil
+	}
+	return runGitWithStdInOut(op, updates, ioutil.Discard, r.localDiskPath, "update-ref", "--stdin")
+}
+
+// runUpstreamFetch runs git-fetch with args and the upstream credential.
+func (r *managedRepository) runUpstreamFetch(ctx context.Context, op RunningOperation, args ...string) error {
+	c, err := r.upstreamCredential()
+	if err != nil {
+		return err
+	}
+	// The automatic gc can remove the packfiles that the requests being
+	// served are reading. They're removed by the maintenance with the
+	// write lock instead.
+	gitArgs := []string{"-c", "gc.auto=0", "-c", "maintenance.auto=false"}
+	gitArgs = append(gitArgs, gitAuthArgs(c)...)
+	gitArgs = append(gitArgs, gitTraceArgs(ctx)...)
+	gitArgs = append(gitArgs, "fetch")
+	return runGit(op, r.localDiskPath, append(gitArgs, args...)...)
+}
+
 func (r *managedRepository) UpstreamURL() *url.URL {
 	u := *r.upstreamURL
 	return &u
 }
 
 func (r *managedRepository) LastUpdateTime() time.Time {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	return r.lastUpdate
+	if t := atomic.LoadInt64(&r.lastUpdate); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
 }
 
-func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
+// RecoverFromBundle verifies and fetches the bundles in order. The bundles
+// after the first one can be incremental bundles that depend on the previous
+// ones. If a bundle fails, the bundles before it stay applied.
+func (r *managedRepository) RecoverFromBundle(bundlePaths ...string) (err error) {
 	op := r.startOperation("ReadBundle")
 	defer func() {
 		op.Done(err)
@@ -236,7 +637,20 @@ func (r *managedRepository) RecoverFromBundle(bundlePath string) (err error) {
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	err = runGit(op, r.localDiskPath, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*")
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+	defer scheduleCacheDiskQuotaCheck(r.config)
+	for _, bundlePath := range bundlePaths {
+		if err = runGit(op, r.localDiskPath, "bundle", "verify", "--quiet", bundlePath); err != nil {
+			err = fmt.Errorf("invalid bundle %s: %v", bundlePath, err)
+			break
+		}
+		if err = runGit(op, r.localDiskPath, "fetch", "--progress", "-f", bundlePath, "refs/*:refs/*"); err != nil {
+			break
+		}
+	}
+	r.notifyRefsUpdate()
 	return
 }
 
@@ -245,59 +659,283 @@ func (r *managedRepository) WriteBundle(w io.Writer) (err error) {
 	defer func() {
 		op.Done(err)
 	}()
+
+	defer r.readLock()()
+	if r.evicted {
+		return errRepositoryEvicted
+	}
 	err = runGitWithStdOut(op, w, r.localDiskPath, "bundle", "create", "-", "--all")
 	return
 }
 
-func (r *managedRepository) hasAnyUpdate(refs map[string]plumbing.Hash) (bool, error) {
+// VerifyBundle checks the bundle with git-bundle-verify. The prerequisites of
+// the bundle should be in the repository.
+func (r *managedRepository) VerifyBundle(bundlePath string) (err error) {
+	op := r.startOperation("VerifyBundle")
+	defer func() {
+		op.Done(err)
+	}()
+
+	defer r.readLock()()
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+	return runGit(op, r.localDiskPath, "bundle", "verify", "--quiet", bundlePath)
+}
+
+// WriteIncrementalBundle writes a bundle of the objects that are not reachable
+// from the base refs, and returns the refs that the bundle is created from. If
+// base is empty, the bundle has all objects. If there's no new object, nothing
+// is written.
+func (r *managedRepository) WriteIncrementalBundle(w io.Writer, base map[string]string) (refs map[string]string, err error) {
+	op := r.startOperation("CreateBundle")
+	defer func() {
+		op.Done(err)
+	}()
+
+	defer r.readLock()()
+	if r.evicted {
+		return nil, errRepositoryEvicted
+	}
+
+	g, err := git.PlainOpen(r.localDiskPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the local cached repository: %v", err)
+	}
+	// Block the fetches only while reading the refs. The bundle is created
+	// from this snapshot so that the refs match the bundle.
+	r.refsMu.RLock()
+	refs, err = readHashRefs(g)
+	r.refsMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		return refs, nil
+	}
+	snapshot, err := r.writeRefsSnapshot(refs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create a snapshot of the refs: %v", err)
+	}
+	defer os.RemoveAll(snapshot)
+
+	excludes := new(bytes.Buffer)
+	seen := map[string]bool{}
+	for _, h := range base {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		// Excluding fewer objects than the base is safe. The bundle just
+		// gets larger.
+		if _, err := g.Object(plumbing.AnyObject, plumbing.NewHash(h)); err != nil {
+			continue
+		}
+		fmt.Fprintf(excludes, "^%s\n", h)
+	}
+	if excludes.Len() != 0 {
+		// git-bundle refuses to create an empty bundle.
+		cw := &countingWriter{}
+		if err := runGitWithStdInOut(op, bytes.NewReader(excludes.Bytes()), cw, snapshot, "rev-list", "--objects", "--all", "--stdin"); err != nil {
+			return nil, err
+		}
+		if cw.n == 0 {
+			return refs, nil
+		}
+	}
+	err = runGitWithStdInOut(op, excludes, w, snapshot, "bundle", "create", "-", "--all", "--stdin")
+	return refs, err
+}
+
+func readHashRefs(g *git.Repository) (map[string]string, error) {
+	refs := map[string]string{}
+	iter, err := g.References()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the references: %v", err)
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && !strings.HasPrefix(ref.Name().String(), fetchStagingRefPrefix) {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the references: %v", err)
+	}
+	return refs, nil
+}
+
+// writeRefsSnapshot creates a repository that has the refs and borrows the
+// objects from the repository with alternates. The caller should remove it.
+// It's created in the system temporary directory so that a snapshot left by a
+// crash is not a part of the repository or the cache.
+func (r *managedRepository) writeRefsSnapshot(refs map[string]string) (_ string, err error) {
+	objects, err := filepath.Abs(filepath.Join(r.localDiskPath, "objects"))
+	if err != nil {
+		return "", err
+	}
+	head, err := ioutil.ReadFile(filepath.Join(r.localDiskPath, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "goblet-refs-snapshot-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err := runGit(noopOperation{}, dir, "init", "--bare", "--quiet"); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "objects", "info", "alternates"), []byte(objects+"\n"), 0640); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "HEAD"), head, 0640); err != nil {
+		return "", err
+	}
+	names := []string{}
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	packedRefs := new(bytes.Buffer)
+	fmt.Fprintln(packedRefs, "# pack-refs with: sorted ")
+	for _, name := range names {
+		fmt.Fprintf(packedRefs, "%s %s\n", refs[name], name)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "packed-refs"), packedRefs.Bytes(), 0640); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// recordUpstreamRefs records the refs advertised by the upstream that are
+// different from the local ones, and returns true if there's any.
+func (r *managedRepository) recordUpstreamRefs(refs map[string]plumbing.Hash) (bool, error) {
+	advertiseTime := time.Now()
 	g, err := git.PlainOpen(r.localDiskPath)
 	if err != nil {
 		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
 	}
+	updated := map[string]plumbing.Hash{}
 	for refName, hash := range refs {
 		ref, err := g.Reference(plumbing.ReferenceName(refName), true)
 		if err == plumbing.ErrReferenceNotFound {
-			return true, nil
+			updated[refName] = hash
+			continue
 		} else if err != nil {
 			return false, fmt.Errorf("cannot open the reference: %v", err)
 		}
 		if ref.Hash() != hash {
-			return true, nil
+			updated[refName] = hash
+		}
+	}
+
+	r.upstreamRefsMu.Lock()
+	defer r.upstreamRefsMu.Unlock()
+	if len(r.upstreamRefs) != 0 {
+		for refName := range refs {
+			delete(r.upstreamRefs, refName)
+		}
+	}
+	if len(updated) != 0 && r.upstreamRefs == nil {
+		r.upstreamRefs = map[string]*advertisedRef{}
+	}
+	for refName, hash := range updated {
+		r.upstreamRefs[refName] = &advertisedRef{hash, advertiseTime}
+	}
+	return len(updated) != 0, nil
+}
+
+// forgetUpstreamRefs removes the refs advertised before t. The fetch started at
+// t has updated the local refs to the same or newer ones.
+func (r *managedRepository) forgetUpstreamRefs(t time.Time) {
+	r.upstreamRefsMu.Lock()
+	defer r.upstreamRefsMu.Unlock()
+	for refName, a := range r.upstreamRefs {
+		if a.advertiseTime.Before(t) {
+			delete(r.upstreamRefs, refName)
 		}
 	}
-	return false, nil
 }
 
+// hasAllWants returns true if the repository has the wanted objects and refs,
+// and the wanted refs are up to date with the upstream advertisement.
 func (r *managedRepository) hasAllWants(hashes []plumbing.Hash, refs []string) (bool, error) {
+	found, upToDate, err := r.checkWants(hashes, refs)
+	return found && upToDate, err
+}
+
+// checkWants returns whether the repository has the wanted objects and refs,
+// and whether the wanted refs point to the hashes that the upstream advertised
+// after the last fetch started. Otherwise, a client that has seen the newer
+// hash in ls-refs would be served the older ref.
+func (r *managedRepository) checkWants(hashes []plumbing.Hash, refs []string) (found, upToDate bool, err error) {
+	defer r.readLock()()
+	if r.evicted {
+		return false, false, errRepositoryEvicted
+	}
+
 	g, err := git.PlainOpen(r.localDiskPath)
 	if err != nil {
-		return false, fmt.Errorf("cannot open the local cached repository: %v", err)
+		return false, false, fmt.Errorf("cannot open the local cached repository: %v", err)
 	}
 
 	for _, hash := range hashes {
 		if _, err := g.Object(plumbing.AnyObject, hash); err == plumbing.ErrObjectNotFound {
-			return false, nil
+			return false, false, nil
 		} else if err != nil {
-			return false, fmt.Errorf("error while looking up an object for want check: %v", err)
+			return false, false, fmt.Errorf("error while looking up an object for want check: %v", err)
 		}
 	}
 
+	upToDate = true
 	for _, refName := range refs {
-		if _, err := g.Reference(plumbing.ReferenceName(refName), true); err == plumbing.ErrReferenceNotFound {
-			return false, nil
+		ref, err := g.Reference(plumbing.ReferenceName(refName), true)
+		if err == plumbing.ErrReferenceNotFound {
+			return false, false, nil
 		} else if err != nil {
-			return false, fmt.Errorf("error while looking up a reference for want check: %v", err)
+			return false, false, fmt.Errorf("error while looking up a reference for want check: %v", err)
+		}
+		r.upstreamRefsMu.Lock()
+		if a, ok := r.upstreamRefs[refName]; ok && a.hash != ref.Hash() {
+			upToDate = false
 		}
+		r.upstreamRefsMu.Unlock()
 	}
-
-	return true, nil
+	return true, upToDate, nil
 }
 
-func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer) error {
-	// If fetch-upstream is running, it's possible that Git returns
-	// incomplete set of objects when the refs being fetched is updated and
-	// it uses ref-in-want.
-	cmd := exec.Command(gitBinary, "upload-pack", "--stateless-rpc", r.localDiskPath)
+// serveFetchLocal runs the command with git-upload-pack. gitConfig is a list
+// of "name=value" passed to it with -c.
+func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2RequestChunk, w io.Writer, gitConfig ...string) error {
+	// Hold the read lock until the response is sent so that the
+	// maintenance doesn't remove the packfiles git-upload-pack is reading.
+	defer r.readLock()()
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+	if _, wantRefs, err := parseFetchWants(command); err != nil {
+		return err
+	} else if len(wantRefs) != 0 {
+		// With ref-in-want, git-upload-pack resolves the wanted refs
+		// by itself. If fetch-upstream updates the refs while it's
+		// running, the wanted-refs section and the pack can be made
+		// from the different refs, and the pack can be incomplete.
+		// Block the refs update until the response is sent.
+		r.refsMu.RLock()
+		defer r.refsMu.RUnlock()
+	}
+
+	args := []string{"-c", hideStagingRefsConfig}
+	for _, c := range gitConfig {
+		args = append(args, "-c", c)
+	}
+	args = append(args, "upload-pack", "--stateless-rpc", r.localDiskPath)
+	cmd := exec.Command(gitBinary, args...)
 	cmd.Env = []string{"GIT_PROTOCOL=version=2"}
 	cmd.Dir = r.localDiskPath
 	cmd.Stdin = newGitRequest(command)
@@ -306,11 +944,37 @@ func (r *managedRepository) serveFetchLocal(command []*gitprotocolio.ProtocolV2R
 	return cmd.Run()
 }
 
+func (r *managedRepository) serveUploadPackV1Local(request []byte, w io.Writer) error {
+	defer r.readLock()()
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+
+	// The ref advertisement is made from the upstream refs, and the local
+	// refs can be different from it. Allow any wants as they are checked
+	// by hasAllWants.
+	cmd := exec.Command(gitBinary, "-c", hideStagingRefsConfig, "-c", "uploadpack.allowAnySHA1InWant=true", "upload-pack", "--stateless-rpc", r.localDiskPath)
+	cmd.Env = []string{}
+	cmd.Dir = r.localDiskPath
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 func (r *managedRepository) startOperation(op string) RunningOperation {
+	var ret RunningOperation = noopOperation{}
 	if r.config.LongRunningOperationLogger != nil {
-		return r.config.LongRunningOperationLogger(op, r.upstreamURL)
+		ret = r.config.LongRunningOperationLogger(op, r.upstreamURL)
+	}
+	t := &trackedOperation{ret, r, op, time.Now()}
+	r.opsMu.Lock()
+	if r.runningOps == nil {
+		r.runningOps = map[*trackedOperation]bool{}
 	}
-	return noopOperation{}
+	r.runningOps[t] = true
+	r.opsMu.Unlock()
+	return t
 }
 
 func runGit(op RunningOperation, gitDir string, arg ...string) error {
@@ -337,6 +1001,50 @@ func runGitWithStdOut(op RunningOperation, w io.Writer, gitDir string, arg ...st
 	return nil
 }
 
+func runGitWithStdInOut(op RunningOperation, stdin io.Reader, w io.Writer, gitDir string, arg ...string) error {
+	cmd := exec.Command(gitBinary, arg...)
+	cmd.Env = []string{}
+	cmd.Dir = gitDir
+	cmd.Stdin = stdin
+	cmd.Stdout = w
+	cmd.Stderr = &operationWriter{op}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run a git command: %v", err)
+	}
+	return nil
+}
+
+// backgroundJob runs a function in the background, one at a time.
+type backgroundJob struct {
+	mu      sync.Mutex
+	running bool
+}
+
+// start runs f in the background unless it's already running.
+func (j *backgroundJob) start(f func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.running {
+		return
+	}
+	j.running = true
+	go func() {
+		f()
+		j.mu.Lock()
+		j.running = false
+		j.mu.Unlock()
+	}()
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
 func newGitRequest(command []*gitprotocolio.ProtocolV2RequestChunk) io.Reader {
 	b := new(bytes.Buffer)
 	for _, c := range command {
@@ -350,6 +1058,29 @@ type noopOperation struct{}
 func (noopOperation) Printf(string, ...interface{}) {}
 func (noopOperation) Done(error)                    {}
 
+// trackedOperation records the running operations and the last error of the
+// repository for the admin API.
+type trackedOperation struct {
+	RunningOperation
+	r         *managedRepository
+	name      string
+	startTime time.Time
+}
+
+func (t *trackedOperation) Done(err error) {
+	t.r.opsMu.Lock()
+	delete(t.r.runningOps, t)
+	if err != nil {
+		t.r.lastError = &OperationError{
+			Operation: t.name,
+			Message:   err.Error(),
+			Time:      time.Now(),
+		}
+	}
+	t.r.opsMu.Unlock()
+	t.RunningOperation.Done(err)
+}
+
 type operationWriter struct {
 	op RunningOperation
 }
@@ -0,0 +1,212 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestRefsUpdateNotifier(t *testing.T) {
+	r := &managedRepository{}
+	r.notifyRefsUpdate()
+
+	ch1 := r.refsUpdateNotifier()
+	ch2 := r.refsUpdateNotifier()
+	select {
+	case <-ch1:
+		t.Fatal("got a notification without an update")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r.notifyRefsUpdate()
+	for _, ch := range []<-chan struct{}{ch1, ch2} {
+		select {
+		case <-ch:
+		case <-time.After(10 * time.Second):
+			t.Fatal("got no notification for the update")
+		}
+	}
+
+	// The waiters for the next update are not woken up by the past one.
+	select {
+	case <-r.refsUpdateNotifier():
+		t.Error("got a notification for the past update")
+	default:
+	}
+}
+
+// newWaitingRepository returns a repository whose upstream fetch never
+// finishes, so that the waiters are woken up only by notifyRefsUpdate.
+func newWaitingRepository(t *testing.T) (*managedRepository, func()) {
+	dir, err := ioutil.TempDir("", "goblet_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "init", "-q", dir).Run(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	r := &managedRepository{localDiskPath: dir}
+	r.runningFetch = newUpstreamFetch()
+	return r, func() { os.RemoveAll(dir) }
+}
+
+func TestFetchUntilHasAllWants_RefsUpdate(t *testing.T) {
+	r, cleanup := newWaitingRepository(t)
+	defer cleanup()
+
+	errs := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			errs <- r.fetchUntilHasAllWants(ctx, nil, []string{"HEAD"})
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The waiters keep waiting if the update doesn't have the wants.
+	r.notifyRefsUpdate()
+	select {
+	case err := <-errs:
+		t.Fatalf("got %v before the wanted ref is created", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cmd := exec.Command("git", "-c", "user.name=goblet", "-c", "user.email=goblet@example.com", "commit", "-q", "--allow-empty", "-m", "test")
+	cmd.Dir = r.localDiskPath
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	r.notifyRefsUpdate()
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFetchUntilHasAllWants_Timeout(t *testing.T) {
+	r, cleanup := newWaitingRepository(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	if err := r.fetchUntilHasAllWants(ctx, nil, []string{"HEAD"}); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(startTime); d < 100*time.Millisecond || d > 10*time.Second {
+		t.Errorf("got a timeout after %v, want after 100ms", d)
+	}
+}
+
+func TestUpdateRefsFromStaging(t *testing.T) {
+	r, cleanup := newMaintenanceTestRepository(t, 2)
+	defer cleanup()
+	dir := r.localDiskPath
+	second := gitCommand(t, dir, "rev-parse", "refs/heads/main")
+	first := gitCommand(t, dir, "rev-parse", "refs/heads/main^")
+	gitCommand(t, dir, "update-ref", "refs/heads/local", second)
+	gitCommand(t, dir, "update-ref", stagingRefName("refs/heads/main"), first)
+	gitCommand(t, dir, "update-ref", stagingRefName("refs/tags/v1"), second)
+
+	if err := r.updateRefsFromStaging(noopOperation{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"refs/heads/main":  first,
+		"refs/tags/v1":     second,
+		"refs/heads/local": second,
+	} {
+		if got := gitCommand(t, dir, "rev-parse", name); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+
+	// The staged refs are not advertised.
+	b := new(bytes.Buffer)
+	command := []*gitprotocolio.ProtocolV2RequestChunk{
+		{Command: "ls-refs"},
+		{EndCapability: true},
+		{EndRequest: true},
+	}
+	if err := r.serveFetchLocal(command, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); !strings.Contains(got, "refs/tags/v1") || strings.Contains(got, fetchStagingRefPrefix) {
+		t.Errorf("got %q, want the refs without the staged ones", got)
+	}
+}
+
+func TestWriteIncrementalBundle_SnapshotOutsideRepository(t *testing.T) {
+	r, cleanup := newMaintenanceTestRepository(t, 2)
+	defer cleanup()
+	dir := r.localDiskPath
+	first := gitCommand(t, dir, "rev-parse", "refs/heads/main^")
+	before := listFileNames(t, dir)
+
+	f, err := ioutil.TempFile("", "goblet_test_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	refs, err := r.WriteIncrementalBundle(f, map[string]string{"refs/heads/main": first})
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := refs["refs/heads/main"], gitCommand(t, dir, "rev-parse", "refs/heads/main"); got != want {
+		t.Errorf("got refs/heads/main %s, want %s", got, want)
+	}
+	gitCommand(t, dir, "bundle", "verify", "-q", f.Name())
+
+	// The snapshot is not created in the repository, so that it's not
+	// left there if the server stops while it's used.
+	snapshot, err := r.writeRefsSnapshot(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(snapshot)
+	if got := listFileNames(t, dir); !reflect.DeepEqual(got, before) {
+		t.Errorf("got %v in the repository, want %v", got, before)
+	}
+	if got, want := gitCommand(t, snapshot, "rev-parse", "refs/heads/main"), refs["refs/heads/main"]; got != want {
+		t.Errorf("got refs/heads/main %s in the snapshot, want %s", got, want)
+	}
+}
+
+func listFileNames(t *testing.T, dir string) []string {
+	t.Helper()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
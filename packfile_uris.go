@@ -0,0 +1,310 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// With the packfile-uris fetch feature, git-upload-pack sends the URIs of the
+// static packs instead of some objects, and the client downloads them
+// separately. This moves the large objects out of the dynamic pack generation.
+//
+// Git supports this only for blobs with uploadpack.blobPackfileUri. Goblet
+// packs the blobs larger than PackfileURIMinBlobSize into a static pack in the
+// repository directory, and serves it at
+// "PackfileURIBaseURL/goblet-packfile/HOST/PATH/pack-HASH.pack", where
+// HOST/PATH is the repository directory under the cache root. The pack is
+// created in the background, and recreated every packfileURIInterval to
+// include the new blobs. The previous pack is kept for the clients that got
+// its URI.
+//
+// The blobPackfileUri config of a pack is written to a file next to the pack,
+// and included in the upload-pack config.
+
+const (
+	packfileURIPath = "/goblet-packfile/"
+
+	packfileURIDir = "goblet-packfile-uris"
+
+	packfileURIInterval = 24 * time.Hour
+)
+
+var packfileNameRE = regexp.MustCompile(`^pack-([0-9a-f]+)\.pack$`)
+
+func packfileURIsEnabled(config *ServerConfig) bool {
+	return config.PackfileURIMinBlobSize != 0 && config.PackfileURIBaseURL != ""
+}
+
+// packfileURIConfig returns the upload-pack config for packfile-uris. If the
+// command accepts packfile URIs, the blobs in the static pack are sent as the
+// URI of the pack.
+func (r *managedRepository) packfileURIConfig(command []*gitprotocolio.ProtocolV2RequestChunk) []string {
+	if !packfileURIsEnabled(r.config) {
+		return nil
+	}
+	// git-upload-pack accepts packfile-uris only with sideband-all.
+	config := []string{"uploadpack.allowSidebandAll=true"}
+	if !hasPackfileURIsArgument(command) {
+		return config
+	}
+	pack, modTime := latestPackfileURIPack(filepath.Join(r.localDiskPath, packfileURIDir))
+	if pack == "" || time.Since(modTime) > packfileURIInterval {
+		// The error is reported by the operation.
+		r.packfileURIJob.start(func() { r.writePackfileURIPack() })
+	}
+	if pack == "" {
+		return config
+	}
+	configPath, err := r.writePackfileURIConfig(pack)
+	if err != nil {
+		// Send the blobs in the response instead.
+		log.Printf("Cannot create the packfile-uris config for %s: %v", r.localDiskPath, err)
+		return config
+	}
+	return append(config, "include.path="+configPath)
+}
+
+func hasPackfileURIsArgument(command []*gitprotocolio.ProtocolV2RequestChunk) bool {
+	for _, ch := range command {
+		if bytes.HasPrefix(ch.Argument, []byte("packfile-uris ")) {
+			return true
+		}
+	}
+	return false
+}
+
+// latestPackfileURIPack returns the hash and the modification time of the
+// latest static pack in dir.
+func latestPackfileURIPack(dir string) (string, time.Time) {
+	packs := listPackfileURIPacks(dir)
+	if len(packs) == 0 {
+		return "", time.Time{}
+	}
+	return packs[0].hash, packs[0].modTime
+}
+
+type packfileURIPack struct {
+	hash    string
+	modTime time.Time
+}
+
+// listPackfileURIPacks returns the static packs in dir, newest first.
+func listPackfileURIPacks(dir string) []packfileURIPack {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	packs := []packfileURIPack{}
+	for _, info := range infos {
+		if m := packfileNameRE.FindStringSubmatch(info.Name()); m != nil {
+			packs = append(packs, packfileURIPack{m[1], info.ModTime()})
+		}
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].modTime.After(packs[j].modTime) })
+	return packs
+}
+
+// writePackfileURIPack creates a static pack of the large blobs. The packs
+// other than the new one and the previous one are deleted.
+func (r *managedRepository) writePackfileURIPack() (err error) {
+	op := r.startOperation("CreatePackfileURIPack")
+	defer func() {
+		op.Done(err)
+	}()
+
+	defer r.readLock()()
+	if r.evicted {
+		return errRepositoryEvicted
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(runGitWithStdOut(op, pw, r.localDiskPath, "cat-file", "--batch-all-objects", "--batch-check=%(objecttype) %(objectname) %(objectsize)"))
+	}()
+	blobs := &bytes.Buffer{}
+	sc := bufio.NewScanner(pr)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 || fields[0] != "blob" {
+			continue
+		}
+		if size, err := strconv.ParseInt(fields[2], 10, 64); err != nil || size <= r.config.PackfileURIMinBlobSize {
+			continue
+		}
+		fmt.Fprintln(blobs, fields[1])
+	}
+	if err := sc.Err(); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	if blobs.Len() == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(r.localDiskPath, packfileURIDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	out := &bytes.Buffer{}
+	if err := runGitWithStdInOut(op, blobs, out, r.localDiskPath, "pack-objects", "--quiet", filepath.Join(dir, "pack")); err != nil {
+		return err
+	}
+	pack := strings.TrimSpace(out.String())
+	// The same set of blobs makes the same pack. Renew it so that it's
+	// not recreated right away.
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(dir, "pack-"+pack+".pack"), now, now); err != nil {
+		return err
+	}
+
+	keep := map[string]bool{}
+	for _, p := range listPackfileURIPacks(dir) {
+		if len(keep) == 2 {
+			break
+		}
+		keep[p.hash] = true
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		// The files are named "pack-HASH.*" and "uris-HASH.config".
+		name := info.Name()
+		if strings.HasPrefix(name, "tmp") {
+			continue
+		}
+		fields := strings.SplitN(strings.SplitN(name, ".", 2)[0], "-", 3)
+		if len(fields) < 2 || !keep[fields[1]] {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+// writePackfileURIConfig writes the blobPackfileUri config of the pack, and
+// returns the path. The existing file is reused.
+func (r *managedRepository) writePackfileURIConfig(pack string) (string, error) {
+	dir := filepath.Join(r.localDiskPath, packfileURIDir)
+	configPath := filepath.Join(dir, "uris-"+pack+".config")
+	if _, err := os.Stat(configPath); err == nil {
+		return configPath, nil
+	}
+	uri, err := url.Parse(r.config.PackfileURIBaseURL)
+	if err != nil {
+		return "", err
+	}
+	repoPath, err := filepath.Rel(r.config.LocalDiskCacheRoot, r.localDiskPath)
+	if err != nil {
+		return "", err
+	}
+	uri.Path = strings.TrimSuffix(uri.Path, "/") + packfileURIPath + filepath.ToSlash(repoPath) + "/pack-" + pack + ".pack"
+
+	idx, err := os.Open(filepath.Join(dir, "pack-"+pack+".idx"))
+	if err != nil {
+		return "", err
+	}
+	defer idx.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(runGitWithStdInOut(noopOperation{}, idx, pw, r.localDiskPath, "show-index"))
+	}()
+
+	f, err := ioutil.TempFile(dir, "tmp-uris-")
+	if err != nil {
+		pr.Close()
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	fmt.Fprintln(bw, "[uploadpack]")
+	sc := bufio.NewScanner(pr)
+	for sc.Scan() {
+		// OFFSET OBJECT_NAME (CRC32)
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		fmt.Fprintf(bw, "\tblobPackfileUri = \"%s %s %s\"\n", fields[1], pack, uri.String())
+	}
+	if err := sc.Err(); err != nil {
+		pr.CloseWithError(err)
+		f.Close()
+		return "", err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), configPath); err != nil {
+		return "", err
+	}
+	return configPath, nil
+}
+
+// packfileHandler serves the static packs advertised by packfile-uris. The
+// repository is found by the directory in the path, not by the upstream URL.
+func (s *httpProxyServer) packfileHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	if !packfileURIsEnabled(s.config) {
+		reporter.reportError(status.Error(codes.NotFound, "packfile-uris is disabled"))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		reporter.reportError(status.Error(codes.InvalidArgument, "accepts only GET"))
+		return
+	}
+
+	i := strings.Index(r.URL.Path, packfileURIPath)
+	repoPath, name := path.Split(r.URL.Path[i+len(packfileURIPath):])
+	if !packfileNameRE.MatchString(name) {
+		reporter.reportError(status.Error(codes.NotFound, "not a pack"))
+		return
+	}
+	for _, elem := range strings.Split(repoPath, "/") {
+		if elem == "." || elem == ".." {
+			reporter.reportError(status.Error(codes.NotFound, "not a repository"))
+			return
+		}
+	}
+	localDiskPath := filepath.Join(s.config.LocalDiskCacheRoot, filepath.FromSlash(repoPath))
+	if repoPath == "" || !isBareRepository(localDiskPath) {
+		reporter.reportError(status.Error(codes.NotFound, "not a repository"))
+		return
+	}
+	serveFile(reporter, w, r, filepath.Join(localDiskPath, packfileURIDir, name))
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// Headers copied from the client request to the upstream request.
+	receivePackRequestHeaders = []string{"Accept", "Content-Encoding", "Content-Type", "Git-Protocol"}
+
+	// Headers copied from the upstream response to the client response.
+	receivePackResponseHeaders = []string{"Cache-Control", "Content-Type", "Expires", "Pragma", "WWW-Authenticate"}
+)
+
+// receivePackHandler forwards the git-receive-pack info/refs and the pack
+// upload to the upstream. Goblet doesn't interpret the push. After a
+// successful push, the repository is fetched from the upstream so that the
+// pushed objects are served from the cache.
+func (s *httpProxyServer) receivePackHandler(reporter *httpErrorReporter, w http.ResponseWriter, r *http.Request) {
+	if !s.config.ForwardPushes {
+		reporter.reportError(status.Error(codes.Unimplemented, "git-receive-pack not supported"))
+		return
+	}
+
+	startTime := time.Now()
+	ctx, err := tag.New(r.Context(), tag.Upsert(CommandTypeKey, "receive-pack"))
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	r = r.WithContext(ctx)
+	reporter.req = r
+
+	repo, err := openManagedRepository(s.config, r.URL)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+
+	isAdvertisement := strings.HasSuffix(r.URL.Path, "/info/refs")
+	resp, err := repo.receivePackUpstream(r, isAdvertisement)
+	if err != nil {
+		reporter.reportError(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range receivePackResponseHeaders {
+		for _, v := range resp.Header[h] {
+			w.Header().Add(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		// The response status is already sent. Just record the error.
+		s.recordReceivePack(r, startTime, status.Errorf(codes.Canceled, "client IO error: %v", err))
+		return
+	}
+
+	if !isAdvertisement && resp.StatusCode == http.StatusOK {
+		// Wait for the fetch so that the pushed objects are in the
+		// cache once the client sees the push finished. Rejected ref
+		// updates are also reported with 200, but the fetch is harmless
+		// in that case.
+		if err := repo.waitForRestore(ctx); err != nil {
+			s.recordReceivePack(r, startTime, err)
+			return
+		}
+		f := repo.requestFetchUpstream()
+		select {
+		case <-f.done:
+			if f.err != nil {
+				s.recordReceivePack(r, startTime, status.Errorf(codes.Internal, "cannot fetch the pushed objects: %v", f.err))
+				return
+			}
+		case <-ctx.Done():
+			s.recordReceivePack(r, startTime, status.FromContextError(ctx.Err()).Err())
+			return
+		}
+	}
+	s.recordReceivePack(r, startTime, errorFromHTTPStatus(resp.StatusCode))
+}
+
+// recordReceivePack records the stats of a forwarded git-receive-pack
+// request. Unlike the other handlers, the error cannot be sent to the
+// client because the upstream response is already relayed.
+func (s *httpProxyServer) recordReceivePack(r *http.Request, startTime time.Time, err error) {
+	code := codes.Internal
+	if st, ok := status.FromError(err); ok {
+		code = st.Code()
+	}
+	stats.RecordWithTags(
+		r.Context(),
+		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, code.String())},
+		InboundCommandCount.M(1),
+		InboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
+	)
+	setSpanError(r.Context(), err)
+
+	if !serverErrorCodes[code] {
+		return
+	}
+	if s.config.ErrorReporter != nil {
+		s.config.ErrorReporter(r, err)
+		return
+	}
+	log.Printf("Error while processing a request: %v", err)
+}
+
+// errorFromHTTPStatus returns an error with the code corresponding to the
+// HTTP status, or nil for 200.
+func errorFromHTTPStatus(httpStatus int) error {
+	code := codes.Unknown
+	switch {
+	case httpStatus == http.StatusOK:
+		return nil
+	case httpStatus == http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case httpStatus == http.StatusForbidden:
+		code = codes.PermissionDenied
+	case httpStatus == http.StatusNotFound:
+		code = codes.NotFound
+	case httpStatus >= 500:
+		code = codes.Unavailable
+	}
+	return status.Errorf(code, "upstream returned %d", httpStatus)
+}
+
+// receivePackUpstream sends the git-receive-pack request to the upstream.
+func (r *managedRepository) receivePackUpstream(clientReq *http.Request, isAdvertisement bool) (*http.Response, error) {
+	u := r.upstreamURL.String()
+	var body io.Reader
+	if isAdvertisement {
+		u += "/info/refs?service=git-receive-pack"
+	} else {
+		u += "/git-receive-pack"
+		body = clientReq.Body
+	}
+	req, err := http.NewRequest(clientReq.Method, u, body)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot construct a request object: %v", err)
+	}
+	if body != nil {
+		req.ContentLength = clientReq.ContentLength
+	}
+	for _, h := range receivePackRequestHeaders {
+		for _, v := range clientReq.Header[h] {
+			req.Header.Add(h, v)
+		}
+	}
+	if r.config.ForwardPushClientCredentials {
+		if h := clientReq.Header.Get("Authorization"); h != "" {
+			req.Header.Set("Authorization", h)
+		}
+	} else {
+		c, err := r.upstreamCredential()
+		if err != nil {
+			return nil, err
+		}
+		if h := c.AuthorizationHeader(); h != "" {
+			req.Header.Set("Authorization", h)
+		}
+	}
+
+	startTime := time.Now()
+	resp, err := upstreamHTTPClient.Do(req.WithContext(clientReq.Context()))
+	logStats("receive-pack", startTime, err)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "cannot send a request to the upstream: %v", err)
+	}
+	return resp, nil
+}
@@ -19,6 +19,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
@@ -36,8 +37,24 @@ var (
 		codes.Unavailable:      true,
 		codes.Unknown:          true,
 	}
+
+	// Current values of the gauge measures. Guarded by gaugeMu.
+	gaugeMu                         sync.Mutex
+	managedRepositoryCount          int64
+	upstreamFetchInFlightCount      int64
+	upstreamFetchWaitingClientCount int64
 )
 
+// addGauge adds delta to the gauge value and records the new value. The
+// values are recorded under the lock so that the last recorded value is the
+// current one.
+func addGauge(m *stats.Int64Measure, v *int64, delta int64) {
+	gaugeMu.Lock()
+	defer gaugeMu.Unlock()
+	*v += delta
+	stats.Record(context.Background(), m.M(*v))
+}
+
 type httpErrorReporter struct {
 	config *ServerConfig
 	req    *http.Request
@@ -56,6 +73,7 @@ func (h *httpErrorReporter) reportError(err error) {
 		[]tag.Mutator{tag.Insert(CommandCanonicalStatusKey, code.String())},
 		InboundCommandCount.M(1),
 	)
+	setSpanError(h.req.Context(), err)
 
 	if code == codes.Unauthenticated {
 		h.w.Header().Add("WWW-Authenticate", "Bearer")
@@ -95,6 +113,7 @@ func (h *gitProtocolHTTPErrorReporter) reportError(ctx context.Context, startTim
 		InboundCommandCount.M(1),
 		InboundCommandProcessingTime.M(int64(time.Now().Sub(startTime)/time.Millisecond)),
 	)
+	setSpanError(ctx, err)
 
 	if err != nil {
 		writeError(h.w, err)
@@ -145,7 +164,7 @@ func (r *monitoringReader) Read(p []byte) (int, error) {
 }
 
 func (r *monitoringReader) Close() error {
-	return r.Close()
+	return r.r.Close()
 }
 
 type monitoringWriter struct {
@@ -0,0 +1,155 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+)
+
+// gaugeRecorder reads the last recorded value of a gauge measure through a
+// view, as the exporters do.
+type gaugeRecorder struct {
+	t    *testing.T
+	view *view.View
+}
+
+func newGaugeRecorder(t *testing.T, m *stats.Int64Measure, v *int64) *gaugeRecorder {
+	t.Helper()
+	g := &gaugeRecorder{t, &view.View{Name: m.Name(), Measure: m, Aggregation: view.LastValue()}}
+	if err := view.Register(g.view); err != nil {
+		t.Fatal(err)
+	}
+	// Record the current value so that the view has a value.
+	addGauge(m, v, 0)
+	return g
+}
+
+func (g *gaugeRecorder) value() int64 {
+	g.t.Helper()
+	rows, err := view.RetrieveData(g.view.Name)
+	if err != nil {
+		g.t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		g.t.Fatalf("got %d rows for %s, want 1", len(rows), g.view.Name)
+	}
+	return int64(rows[0].Data.(*view.LastValueData).Value)
+}
+
+func (g *gaugeRecorder) close() {
+	view.Unregister(g.view)
+}
+
+func TestGauge_ManagedRepositoryCount(t *testing.T) {
+	g := newGaugeRecorder(t, ManagedRepositoryCount, &managedRepositoryCount)
+	defer g.close()
+	base := g.value()
+
+	r, cleanup := newWaitingRepository(t)
+	defer cleanup()
+	u := &url.URL{Scheme: "https", Host: "example.com", Path: "/repo"}
+	m := getManagedRepo(r.localDiskPath, u, &ServerConfig{})
+	defer managedRepos.Delete(r.localDiskPath)
+	if got, want := g.value(), base+1; got != want {
+		t.Errorf("got %d after opening a repository, want %d", got, want)
+	}
+	getManagedRepo(r.localDiskPath, u, &ServerConfig{})
+	if got, want := g.value(), base+1; got != want {
+		t.Errorf("got %d after opening the same repository, want %d", got, want)
+	}
+	if err := m.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.value(); got != base {
+		t.Errorf("got %d after the eviction, want %d", got, base)
+	}
+	// Evicting it again doesn't change the count.
+	if err := m.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.value(); got != base {
+		t.Errorf("got %d after the second eviction, want %d", got, base)
+	}
+}
+
+func TestGauge_UpstreamFetches(t *testing.T) {
+	inFlight := newGaugeRecorder(t, UpstreamFetchInFlightCount, &upstreamFetchInFlightCount)
+	defer inFlight.close()
+	waiting := newGaugeRecorder(t, UpstreamFetchWaitingClientCount, &upstreamFetchWaitingClientCount)
+	defer waiting.close()
+	baseInFlight, baseWaiting := inFlight.value(), waiting.value()
+
+	r, cleanup := newWaitingRepository(t)
+	defer cleanup()
+	// Block the fetch when it starts.
+	var once sync.Once
+	started := make(chan struct{})
+	release := make(chan struct{})
+	r.upstreamURL = &url.URL{Scheme: "https", Host: "example.com", Path: "/repo"}
+	r.config = &ServerConfig{
+		CredentialProvider: NewStaticCredentialProvider(nil),
+		LongRunningOperationLogger: func(action string, u *url.URL) RunningOperation {
+			if action == "FetchUpstream" {
+				once.Do(func() {
+					close(started)
+					<-release
+				})
+			}
+			return noopOperation{}
+		},
+	}
+	r.runningFetch = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- r.fetchUntilHasAllWants(ctx, nil, []string{"HEAD"})
+		}()
+	}
+	<-started
+	deadline := time.Now().Add(10 * time.Second)
+	for waiting.value() != baseWaiting+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := waiting.value(), baseWaiting+2; got != want {
+		t.Errorf("got %d waiting clients, want %d", got, want)
+	}
+	if got, want := inFlight.value(), baseInFlight+1; got != want {
+		t.Errorf("got %d fetches in flight, want %d", got, want)
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		<-errs
+	}
+	if got := waiting.value(); got != baseWaiting {
+		t.Errorf("got %d waiting clients after they are done, want %d", got, baseWaiting)
+	}
+
+	f := r.requestFetchUpstream()
+	close(release)
+	<-f.done
+	if got := inFlight.value(); got != baseInFlight {
+		t.Errorf("got %d fetches in flight after they are done, want %d", got, baseInFlight)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+
+	"google.golang.org/grpc/status"
+)
+
+// The restore of a repository from a backup runs in the background while the
+// server accepts requests. A restore is queued first, and then started by a
+// restore worker.
+//
+// The requests to a repository whose restore is running wait for it. If the
+// restore is still queued, it's cancelled and the requests fetch from the
+// upstream instead, as it's faster than waiting for the other restores.
+// Otherwise the restore could overwrite the refs fetched from the upstream
+// with the older ones in the backup.
+//
+// With ServerConfig.RepositoryRestorer, a repository is restored when it's
+// created by the first request instead. The restore starts without being
+// queued, and the other requests wait for it.
+
+const (
+	restoreNone = iota
+	restoreQueued
+	restoreRunning
+)
+
+// QueueRestore queues a restore of the repository, so that the requests to it
+// wait for the restore. The returned function runs restore unless a request
+// has cancelled the queued restore, and then releases the waiting requests. It
+// returns false if restore is skipped.
+func QueueRestore(m ManagedRepository) func(restore func() error) (bool, error) {
+	r, ok := m.(*managedRepository)
+	if !ok {
+		return func(restore func() error) (bool, error) {
+			return true, restore()
+		}
+	}
+	r.queueRestore()
+	return func(restore func() error) (bool, error) {
+		if !r.startRestore() {
+			return false, nil
+		}
+		defer r.finishRestore()
+		return true, restore()
+	}
+}
+
+// queueRestore marks the repository as waiting for a restore.
+func (r *managedRepository) queueRestore() {
+	r.restoreMu.Lock()
+	defer r.restoreMu.Unlock()
+	if r.restoreState == restoreNone {
+		r.restoreState = restoreQueued
+		r.restoreDone = make(chan struct{})
+	}
+}
+
+// startRestore marks the queued restore as running. It returns false if the
+// restore is cancelled by a request, and then the restore should be skipped.
+func (r *managedRepository) startRestore() bool {
+	r.restoreMu.Lock()
+	defer r.restoreMu.Unlock()
+	if r.restoreState != restoreQueued {
+		return false
+	}
+	r.restoreState = restoreRunning
+	return true
+}
+
+// beginRestore marks the repository as being restored without queueing it.
+func (r *managedRepository) beginRestore() {
+	r.restoreMu.Lock()
+	defer r.restoreMu.Unlock()
+	if r.restoreState == restoreNone {
+		r.restoreDone = make(chan struct{})
+	}
+	r.restoreState = restoreRunning
+}
+
+// restoreRepository seeds the repository with RepositoryRestorer.
+func (r *managedRepository) restoreRepository() {
+	op := r.startOperation("RestoreRepository")
+	defer r.finishRestore()
+	op.Done(r.config.RepositoryRestorer(r))
+}
+
+// finishRestore releases the requests waiting for the restore.
+func (r *managedRepository) finishRestore() {
+	r.restoreMu.Lock()
+	defer r.restoreMu.Unlock()
+	r.finishRestoreLocked()
+}
+
+func (r *managedRepository) finishRestoreLocked() {
+	if r.restoreState == restoreNone {
+		return
+	}
+	r.restoreState = restoreNone
+	close(r.restoreDone)
+}
+
+// waitForRestore waits for the running restore, or cancels the queued one.
+func (r *managedRepository) waitForRestore(ctx context.Context) error {
+	r.restoreMu.Lock()
+	switch r.restoreState {
+	case restoreNone:
+		r.restoreMu.Unlock()
+		return nil
+	case restoreQueued:
+		r.finishRestoreLocked()
+		r.restoreMu.Unlock()
+		return nil
+	}
+	done := r.restoreDone
+	r.restoreMu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
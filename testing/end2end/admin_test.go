@@ -0,0 +1,140 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func adminRequest(t *testing.T, ts *goblettest.TestServer, method, path string, v interface{}) int {
+	req, err := http.NewRequest(method, ts.AdminServerURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// waitForUpstreamFetch waits until the proxy finishes fetching the upstream.
+// A client can be served with the fetched objects before the proxy updates the
+// refs.
+func waitForUpstreamFetch(t *testing.T, ts *goblettest.TestServer) {
+	param := "?url=" + url.QueryEscape(ts.ProxyServerURL)
+	for i := 0; i < 100; i++ {
+		var st goblet.RepositoryStatus
+		if code := adminRequest(t, ts, "GET", "/repositories/status"+param, &st); code != http.StatusOK {
+			t.Fatalf("status: got %d", code)
+		}
+		running := false
+		for _, op := range st.RunningOperations {
+			if op.Name == "FetchUpstream" {
+				running = true
+			}
+		}
+		if !running && !st.LastUpdateTime.IsZero() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("the upstream fetch doesn't finish")
+}
+
+func TestAdmin(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	waitForUpstreamFetch(t, ts)
+
+	var repos []*goblet.RepositoryStatus
+	if code := adminRequest(t, ts, "GET", "/repositories", &repos); code != http.StatusOK {
+		t.Fatalf("list: got %d", code)
+	}
+	// The managed repositories of the other tests can be listed.
+	var repo *goblet.RepositoryStatus
+	for _, r := range repos {
+		if strings.HasPrefix(r.UpstreamURL, ts.UpstreamServerURL) {
+			repo = r
+		}
+	}
+	if repo == nil {
+		t.Fatalf("list: %s is not listed", ts.UpstreamServerURL)
+	}
+	if repo.LastUpdateTime.IsZero() || repo.RefCount == 0 || repo.DiskUsageBytes == 0 {
+		t.Errorf("list: got an unexpected status %+v", repo)
+	}
+
+	param := "?url=" + url.QueryEscape(ts.ProxyServerURL)
+	if code := adminRequest(t, ts, "POST", "/repositories/maintenance"+param, nil); code != http.StatusOK {
+		t.Errorf("maintenance: got %d", code)
+	}
+	if code := adminRequest(t, ts, "POST", "/repositories/evict"+param, nil); code != http.StatusNoContent {
+		t.Errorf("evict: got %d", code)
+	}
+	if code := adminRequest(t, ts, "GET", "/repositories/status"+param, nil); code != http.StatusNotFound {
+		t.Errorf("status after evict: got %d", code)
+	}
+	var st goblet.RepositoryStatus
+	if code := adminRequest(t, ts, "POST", "/repositories/refresh"+param, &st); code != http.StatusOK {
+		t.Errorf("refresh: got %d", code)
+	} else if st.RefCount == 0 {
+		t.Errorf("refresh: got no refs")
+	}
+}
+
+func TestAdmin_Unauthenticated(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.AdminServerURL + "/repositories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,349 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/goblet"
+	"github.com/google/goblet/backup"
+	goblettest "github.com/google/goblet/testing"
+)
+
+func newTestReaderWriter(t *testing.T, store backup.ObjectStore) (*backup.ReaderWriter, func()) {
+	dir, err := ioutil.TempDir("", "goblet_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := &backup.ReaderWriter{
+		Store:        store,
+		ManifestName: "test",
+		// The backup URLs are already canonicalized.
+		Config: &goblet.ServerConfig{
+			LocalDiskCacheRoot: dir,
+			URLCanonializer:    func(u *url.URL) (*url.URL, error) { return u, nil },
+			TokenSource:        goblettest.TestTokenSource,
+		},
+		Logger: log.New(ioutil.Discard, "", 0),
+	}
+	return rw, func() { os.RemoveAll(dir) }
+}
+
+func restoredMaster(t *testing.T, rw *backup.ReaderWriter, ts *goblettest.TestServer) string {
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := goblettest.GitRepo(filepath.Join(rw.Config.LocalDiskCacheRoot, u.Host, u.Path))
+	got, err := restored.Run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(got)
+}
+
+// fetchNewCommit creates a commit in the upstream and fetches it through the
+// proxy.
+func fetchNewCommit(t *testing.T, ts *goblettest.TestServer, client goblettest.GitRepo) string {
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	waitForUpstreamFetch(t, ts)
+	return strings.TrimSpace(want)
+}
+
+func TestBackup_LocalObjectStore(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	want, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+	waitForUpstreamFetch(t, ts)
+
+	storeDir, err := ioutil.TempDir("", "goblet_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := backup.NewLocalObjectStore(storeDir)
+
+	rw, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	rw.SaveBackup()
+
+	manifests, err := store.List(context.Background(), "goblet-repository-manifests/test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 {
+		t.Fatalf("got manifests %v, want one manifest", manifests)
+	}
+
+	rw.RecoverFromBackup()
+	if got := restoredMaster(t, rw, ts); got != strings.TrimSpace(want) {
+		t.Errorf("restored master is %s, want %s", got, want)
+	}
+}
+
+func TestBackup_Incremental(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+
+	storeDir, err := ioutil.TempDir("", "goblet_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := backup.NewLocalObjectStore(storeDir)
+
+	fetchNewCommit(t, ts, client)
+	rw, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	rw.SaveBackup()
+
+	// The backup compares the update time in seconds.
+	time.Sleep(time.Second)
+	want := fetchNewCommit(t, ts, client)
+	rw.SaveBackup()
+
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := store.List(context.Background(), path.Join(u.Host, u.Path)+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incremental := 0
+	for _, name := range names {
+		if strings.HasSuffix(name, ".incremental") {
+			incremental++
+		}
+	}
+	if len(names) != 3 || incremental != 1 {
+		t.Errorf("got %v, want a full bundle, an incremental bundle, and a chain", names)
+	}
+
+	restore, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	restore.RecoverFromBackup()
+	if got := restoredMaster(t, restore, ts); got != want {
+		t.Errorf("restored master is %s, want %s", got, want)
+	}
+}
+
+func TestBackup_CorruptedBundle(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+
+	storeDir, err := ioutil.TempDir("", "goblet_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := backup.NewLocalObjectStore(storeDir)
+
+	want := fetchNewCommit(t, ts, client)
+	rw, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	rw.SaveBackup()
+
+	// The backup compares the update time in seconds.
+	time.Sleep(time.Second)
+	fetchNewCommit(t, ts, client)
+	rw.SaveBackup()
+
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := store.List(context.Background(), path.Join(u.Host, u.Path)+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := false
+	for _, name := range names {
+		if strings.HasSuffix(name, ".incremental") {
+			if err := ioutil.WriteFile(filepath.Join(storeDir, name), []byte("corrupted"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			corrupted = true
+		}
+	}
+	if !corrupted {
+		t.Fatalf("got %v, want an incremental bundle", names)
+	}
+
+	// The full bundle before the corrupted one is restored.
+	restore, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	restore.RecoverFromBackup()
+	if got := restoredMaster(t, restore, ts); got != want {
+		t.Errorf("restored master is %s, want %s", got, want)
+	}
+}
+
+func TestBackup_ParallelRestore(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "goblet_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := backup.NewLocalObjectStore(storeDir)
+
+	servers := []*goblettest.TestServer{}
+	wants := []string{}
+	for i := 0; i < 3; i++ {
+		ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+			RequestAuthorizer: goblettest.TestRequestAuthorizer,
+			TokenSource:       goblettest.TestTokenSource,
+		})
+		defer ts.Close()
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		servers = append(servers, ts)
+		wants = append(wants, fetchNewCommit(t, ts, client))
+	}
+	rw, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	rw.SaveBackup()
+
+	restore, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	restore.RestoreConcurrency = 2
+	restore.RecoverFromBackup()
+	for i, ts := range servers {
+		if got := restoredMaster(t, restore, ts); got != wants[i] {
+			t.Errorf("restored master of %s is %s, want %s", ts.UpstreamServerURL, got, wants[i])
+		}
+	}
+}
+
+func TestBackup_LazyRestore(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+
+	storeDir, err := ioutil.TempDir("", "goblet_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storeDir)
+	store := backup.NewLocalObjectStore(storeDir)
+
+	want := fetchNewCommit(t, ts, client)
+	rw, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	rw.SaveBackup()
+
+	restore, cleanup := newTestReaderWriter(t, store)
+	defer cleanup()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	restore.Config.RepositoryRestorer = func(m goblet.ManagedRepository) error {
+		close(started)
+		<-release
+		return restore.RestoreRepository(m)
+	}
+	u, err := url.Parse(ts.UpstreamServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The repository is restored when it's opened, before fetching the
+	// upstream.
+	opened := make(chan error)
+	go func() {
+		_, err := goblet.OpenManagedRepository(restore.Config, u)
+		opened <- err
+	}()
+	<-started
+
+	// A protocol v0/v1 client waits for the restore too.
+	restore.Config.URLCanonializer = func(*url.URL) (*url.URL, error) {
+		return url.Parse(ts.UpstreamServerURL)
+	}
+	restore.Config.RequestAuthorizer = goblettest.TestRequestAuthorizer
+	proxy := httptest.NewServer(goblet.HTTPHandler(restore.Config))
+	defer proxy.Close()
+	type lsRemoteResult struct {
+		out string
+		err error
+	}
+	lsRemote := make(chan lsRemoteResult)
+	go func() {
+		out, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "protocol.version=1", "ls-remote", proxy.URL, "refs/heads/master")
+		lsRemote <- lsRemoteResult{out, err}
+	}()
+	select {
+	case res := <-lsRemote:
+		close(release)
+		t.Fatalf("got the refs %q before the restore finishes: %v", res.out, res.err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	close(release)
+
+	if err := <-opened; err != nil {
+		t.Fatal(err)
+	}
+	if got := restoredMaster(t, restore, ts); got != want {
+		t.Errorf("restored master is %s, want %s", got, want)
+	}
+	if res := <-lsRemote; res.err != nil {
+		t.Error(res.err)
+	} else if !strings.HasPrefix(res.out, want) {
+		t.Errorf("got %q, want the master %s", res.out, want)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	goblettest "github.com/google/goblet/testing"
+)
+
+// bundleURIRequest sends the bundle-uri command, and returns the bundle list.
+func bundleURIRequest(t *testing.T, ts *goblettest.TestServer) map[string]string {
+	body := &bytes.Buffer{}
+	for _, pkt := range []gitprotocolio.Packet{
+		gitprotocolio.BytesPacket("command=bundle-uri\n"),
+		gitprotocolio.DelimPacket{},
+		gitprotocolio.FlushPacket{},
+	} {
+		body.Write(pkt.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"/git-upload-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	list := map[string]string{}
+	sc := gitprotocolio.NewPacketScanner(resp.Body)
+	for sc.Scan() {
+		p, ok := sc.Packet().(gitprotocolio.BytesPacket)
+		if !ok {
+			break
+		}
+		kv := strings.SplitN(strings.TrimSuffix(string(p), "\n"), "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("unexpected line: %q", p)
+		}
+		list[kv[0]] = kv[1]
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestBundleURI(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		BundleURITTL:      time.Hour,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	want := fetchNewCommit(t, ts, client)
+
+	// The first request has no bundle, and it starts creating one.
+	var list map[string]string
+	for i := 0; i < 100; i++ {
+		list = bundleURIRequest(t, ts)
+		if len(list) != 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	uri := list["bundle.goblet.uri"]
+	if uri != ts.ProxyServerURL+"/goblet-bundle" {
+		t.Fatalf("got bundle list %v, want a bundle served by the proxy", list)
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d for the bundle, want %d", resp.StatusCode, http.StatusOK)
+	}
+	bundlePath := filepath.Join(string(client), "goblet.bundle")
+	f, err := os.Create(bundlePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if got, err := client.Run("bundle", "list-heads", bundlePath, "refs/heads/master"); err != nil {
+		t.Error(err)
+	} else if !strings.HasPrefix(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -15,8 +15,15 @@
 package end2end
 
 import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/gitprotocolio"
 	goblettest "github.com/google/goblet/testing"
 )
 
@@ -81,3 +88,252 @@ func TestFetch_ForceFetchUpdate(t *testing.T) {
 		t.Errorf("got %s, want %s", got, want)
 	}
 }
+
+func TestFetch_ProtocolV0V1(t *testing.T) {
+	for _, version := range []string{"0", "1"} {
+		t.Run("version="+version, func(t *testing.T) {
+			ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+				RequestAuthorizer: goblettest.TestRequestAuthorizer,
+				TokenSource:       goblettest.TestTokenSource,
+			})
+			defer ts.Close()
+
+			want, err := ts.CreateRandomCommitUpstream()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client := goblettest.NewLocalGitRepo()
+			defer client.Close()
+			if _, err := client.Run("-c", "protocol.version="+version, "-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+				t.Error(err)
+			} else if got != want {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestFetch_WantRef(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	want, err := pushClient.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), "master:refs/changes/01/1/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client sends want-ref as the proxy advertises ref-in-want.
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "refs/changes/01/1/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestFetch_ConcurrentWithMaintenance(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	clients := []goblettest.GitRepo{}
+	for i := 0; i < 4; i++ {
+		client := goblettest.NewLocalGitRepo()
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	if _, err := clients[0].Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	param := "?url=" + url.QueryEscape(ts.ProxyServerURL)
+	for round := 0; round < 5; round++ {
+		want, err := ts.CreateRandomCommitUpstream()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errs := make([]error, len(clients))
+		var wg sync.WaitGroup
+		for i, client := range clients {
+			args := []string{"-c", "http.extraHeader=Authorization: Bearer " + goblettest.ValidClientAuthToken}
+			switch i {
+			case 1:
+				// want-ref
+				args = append(args, "fetch", ts.ProxyServerURL, "refs/heads/master")
+			case 2:
+				args = append(args, "-c", "protocol.version=1", "fetch", ts.ProxyServerURL, "master")
+			default:
+				args = append(args, "fetch", ts.ProxyServerURL)
+			}
+			wg.Add(1)
+			go func(i int, client goblettest.GitRepo, args []string) {
+				defer wg.Done()
+				if _, err := client.Run(args...); err != nil {
+					errs[i] = err
+				} else if got, err := client.Run("rev-parse", "FETCH_HEAD"); err != nil {
+					errs[i] = err
+				} else if got != want {
+					errs[i] = fmt.Errorf("got %s, want %s", got, want)
+				}
+			}(i, client, args)
+		}
+		// Rewrite the packfiles and update the refs while the fetches
+		// are served.
+		if code := adminRequest(t, ts, "POST", "/repositories/maintenance"+param, nil); code != http.StatusOK {
+			t.Errorf("maintenance: got %d", code)
+		}
+		if code := adminRequest(t, ts, "POST", "/repositories/refresh"+param, nil); code != http.StatusOK {
+			t.Errorf("refresh: got %d", code)
+		}
+		wg.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				t.Errorf("round %d, client %d: %v", round, i, err)
+			}
+		}
+	}
+}
+
+// fetchRequest sends the fetch command that wants the hash. The started
+// channel, if not nil, is closed when the proxy starts the response, which is
+// before it waits for the upstream fetch.
+func fetchRequest(ts *goblettest.TestServer, hash string, started chan<- struct{}) error {
+	body := &bytes.Buffer{}
+	for _, pkt := range []gitprotocolio.Packet{
+		gitprotocolio.BytesPacket("command=fetch\n"),
+		gitprotocolio.DelimPacket{},
+		gitprotocolio.BytesPacket("want " + hash + "\n"),
+		gitprotocolio.BytesPacket("done\n"),
+		gitprotocolio.FlushPacket{},
+	} {
+		body.Write(pkt.EncodeToPktLine())
+	}
+	req, err := http.NewRequest("POST", ts.ProxyServerURL+"/git-upload-pack", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+goblettest.ValidClientAuthToken)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %d", resp.StatusCode)
+	}
+
+	sc := gitprotocolio.NewPacketScanner(resp.Body)
+	for sc.Scan() {
+		p, ok := sc.Packet().(gitprotocolio.BytesPacket)
+		if !ok {
+			continue
+		}
+		if string(p) == "packfile\n" && started != nil {
+			close(started)
+			started = nil
+		} else if len(p) > 0 && p[0] == 3 {
+			return fmt.Errorf("got an error: %s", p[1:])
+		}
+	}
+	return sc.Err()
+}
+
+// waitForUpstreamFetchCount waits until the upstream receives n git-fetch
+// sessions and the proxy finishes the upstream fetch.
+func waitForUpstreamFetchCount(t *testing.T, ts *goblettest.TestServer, n int) {
+	for i := 0; i < 100 && ts.UpstreamFetchCount() < n; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	waitForUpstreamFetch(t, ts)
+	if got := ts.UpstreamFetchCount(); got != n {
+		t.Errorf("got %d git-fetch sessions to the upstream, want %d", got, n)
+	}
+}
+
+func TestFetch_CoalesceUpstreamFetches(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	hash, err := ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchRequest(ts, hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitForUpstreamFetch(t, ts)
+
+	// An upstream fetch runs git-fetch once. The refs are updated from the
+	// fetched ones without contacting the upstream again.
+	count := ts.UpstreamFetchCount()
+	hash, err = ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchRequest(ts, hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	count++
+	waitForUpstreamFetchCount(t, ts, count)
+
+	// The first cache miss starts an upstream fetch. The others arrive
+	// while it's running, and share one follow-up fetch.
+	hash, err = ts.CreateRandomCommitUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := ts.BlockUpstreamFetches()
+	errs := make([]error, 5)
+	var wg sync.WaitGroup
+	for i := range errs {
+		started := make(chan struct{})
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fetchRequest(ts, hash, started)
+		}(i)
+		select {
+		case <-started:
+		case <-time.After(10 * time.Second):
+			t.Errorf("request %d doesn't start", i)
+		}
+	}
+	release()
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	count += 2
+	waitForUpstreamFetchCount(t, ts, count)
+}
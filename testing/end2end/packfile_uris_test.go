@@ -0,0 +1,93 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestPackfileURIs(t *testing.T) {
+	var mu sync.Mutex
+	packRequests := 0
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer:      goblettest.TestRequestAuthorizer,
+		TokenSource:            goblettest.TestTokenSource,
+		PackfileURIMinBlobSize: 1024,
+		RequestLogger: func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration) {
+			if strings.Contains(r.URL.Path, "/goblet-packfile/") && status == http.StatusOK {
+				mu.Lock()
+				packRequests++
+				mu.Unlock()
+			}
+		},
+	})
+	defer ts.Close()
+
+	pushClient := goblettest.NewLocalGitRepo()
+	defer pushClient.Close()
+	content := make([]byte, 8192)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(string(pushClient), "large"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("add", "large"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("commit", "--message=large blob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pushClient.Run("push", string(ts.UpstreamGitRepo), "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := pushClient.Run("rev-parse", "master:large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob = strings.TrimSpace(blob)
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	// The first clones don't have the static pack, and they start creating
+	// it.
+	for i := 0; i < 50; i++ {
+		dir := fmt.Sprintf("clone%d", i)
+		if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "-c", "fetch.uriProtocols=http", "clone", "--bare", ts.ProxyServerURL, dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Run("--git-dir="+dir, "cat-file", "-e", blob); err != nil {
+			t.Fatalf("the large blob is not fetched: %v", err)
+		}
+		mu.Lock()
+		n := packRequests
+		mu.Unlock()
+		if n != 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("the static pack is not downloaded")
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+)
+
+func TestPush_Forward(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+		ServeStaleLsRefs:  true,
+		ForwardPushes:     true,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("reset", "--hard", "FETCH_HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := client.CreateRandomCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "push", ts.ProxyServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := ts.UpstreamGitRepo.Run("rev-parse", "master"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("upstream: got %s, want %s", got, want)
+	}
+
+	// The pushed commit should be in the cache without the upstream.
+	ts.SetUpstreamAvailable(false)
+	fetchClient := goblettest.NewLocalGitRepo()
+	defer fetchClient.Close()
+	if _, err := fetchClient.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL, "master"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fetchClient.Run("rev-parse", "FETCH_HEAD"); err != nil {
+		t.Error(err)
+	} else if got != want {
+		t.Errorf("cache: got %s, want %s", got, want)
+	}
+}
+
+func TestPush_NotForwarded(t *testing.T) {
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.CreateRandomCommit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "push", ts.ProxyServerURL, "master:master"); err == nil {
+		t.Error("push succeeded without ForwardPushes")
+	}
+}
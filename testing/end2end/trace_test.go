@@ -0,0 +1,89 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"sync"
+	"testing"
+
+	goblettest "github.com/google/goblet/testing"
+	"go.opencensus.io/trace"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) find(name string) *trace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTrace_Fetch(t *testing.T) {
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	ts := goblettest.NewTestServer(&goblettest.TestServerConfig{
+		RequestAuthorizer: goblettest.TestRequestAuthorizer,
+		TokenSource:       goblettest.TestTokenSource,
+	})
+	defer ts.Close()
+
+	if _, err := ts.CreateRandomCommitUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	client := goblettest.NewLocalGitRepo()
+	defer client.Close()
+	if _, err := client.Run("-c", "http.extraHeader=Authorization: Bearer "+goblettest.ValidClientAuthToken, "fetch", ts.ProxyServerURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream fetch is triggered by ls-refs and runs in the
+	// background. Whether the fetch command waits for it depends on the
+	// timing, so only the spans on the request path are checked.
+	for _, name := range []string{
+		"goblet/http",
+		"goblet/authorize",
+		"goblet/command/ls-refs",
+		"goblet/ls-refs-upstream",
+		"goblet/command/fetch",
+		"goblet/serve-fetch-local",
+	} {
+		if rec.find(name) == nil {
+			t.Errorf("span %s is not recorded", name)
+		}
+	}
+
+	lsRefs, upstream := rec.find("goblet/command/ls-refs"), rec.find("goblet/ls-refs-upstream")
+	if lsRefs != nil && upstream != nil && upstream.ParentSpanID != lsRefs.SpanID {
+		t.Errorf("goblet/ls-refs-upstream is not a child of goblet/command/ls-refs")
+	}
+}
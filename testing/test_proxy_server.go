@@ -25,6 +25,8 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/goblet"
@@ -58,6 +60,14 @@ type TestServer struct {
 	UpstreamServerURL string
 	proxyServer       *httptest.Server
 	ProxyServerURL    string
+	adminServer       *httptest.Server
+	AdminServerURL    string
+	upstreamDown      int32
+
+	upstreamFetchCount int32
+	// upstreamFetchGate is closed when the blocked fetches can proceed.
+	upstreamFetchGateMu sync.Mutex
+	upstreamFetchGate   chan struct{}
 }
 
 type TestServerConfig struct {
@@ -65,6 +75,11 @@ type TestServerConfig struct {
 	TokenSource       oauth2.TokenSource
 	ErrorReporter     func(*http.Request, error)
 	RequestLogger     func(r *http.Request, status int, requestSize, responseSize int64, latency time.Duration)
+	ServeStaleLsRefs  bool
+	ForwardPushes     bool
+	BundleURITTL      time.Duration
+
+	PackfileURIMinBlobSize int64
 }
 
 func NewTestServer(config *TestServerConfig) *TestServer {
@@ -85,15 +100,26 @@ func NewTestServer(config *TestServerConfig) *TestServer {
 			log.Fatal(err)
 		}
 		config := &goblet.ServerConfig{
-			LocalDiskCacheRoot: dir,
-			URLCanonializer:    s.testURLCanonicalizer,
-			RequestAuthorizer:  config.RequestAuthorizer,
-			TokenSource:        config.TokenSource,
-			ErrorReporter:      config.ErrorReporter,
-			RequestLogger:      config.RequestLogger,
+			LocalDiskCacheRoot:     dir,
+			URLCanonializer:        s.testURLCanonicalizer,
+			RequestAuthorizer:      config.RequestAuthorizer,
+			TokenSource:            config.TokenSource,
+			ErrorReporter:          config.ErrorReporter,
+			RequestLogger:          config.RequestLogger,
+			ServeStaleLsRefs:       config.ServeStaleLsRefs,
+			ForwardPushes:          config.ForwardPushes,
+			BundleURITTL:           config.BundleURITTL,
+			PackfileURIMinBlobSize: config.PackfileURIMinBlobSize,
+			// The admin API uses the same client token.
+			AdminRequestAuthorizer: config.RequestAuthorizer,
 		}
 		s.proxyServer = httptest.NewServer(goblet.HTTPHandler(config))
 		s.ProxyServerURL = s.proxyServer.URL
+		if config.PackfileURIMinBlobSize != 0 {
+			config.PackfileURIBaseURL = s.ProxyServerURL
+		}
+		s.adminServer = httptest.NewServer(goblet.AdminHTTPHandler(config))
+		s.AdminServerURL = s.adminServer.URL
 	}
 	return s
 }
@@ -118,10 +144,24 @@ func (s *TestServer) testURLCanonicalizer(u *url.URL) (*url.URL, error) {
 }
 
 func (s *TestServer) upstreamServerHandler(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&s.upstreamDown) != 0 {
+		http.Error(w, "upstream is down", http.StatusServiceUnavailable)
+		return
+	}
 	if req.Header.Get("Authorization") != "Bearer "+validServerAuthToken {
 		http.Error(w, "invalid authenticator", http.StatusForbidden)
 		return
 	}
+	if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/info/refs") && req.URL.Query().Get("service") == "git-upload-pack" {
+		// Each git-fetch starts with the ref advertisement.
+		atomic.AddInt32(&s.upstreamFetchCount, 1)
+		s.upstreamFetchGateMu.Lock()
+		gate := s.upstreamFetchGate
+		s.upstreamFetchGateMu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+	}
 
 	h := &cgi.Handler{
 		Path: gitBinary,
@@ -159,9 +199,41 @@ func (s *TestServer) CreateRandomCommitUpstream() (string, error) {
 
 }
 
+// SetUpstreamAvailable makes the upstream server respond with 503 when
+// available is false.
+func (s *TestServer) SetUpstreamAvailable(available bool) {
+	var v int32
+	if !available {
+		v = 1
+	}
+	atomic.StoreInt32(&s.upstreamDown, v)
+}
+
+// UpstreamFetchCount returns the number of git-fetch sessions that the
+// upstream server has received.
+func (s *TestServer) UpstreamFetchCount() int {
+	return int(atomic.LoadInt32(&s.upstreamFetchCount))
+}
+
+// BlockUpstreamFetches makes the git-fetch sessions to the upstream server wait
+// until the returned function is called.
+func (s *TestServer) BlockUpstreamFetches() func() {
+	gate := make(chan struct{})
+	s.upstreamFetchGateMu.Lock()
+	s.upstreamFetchGate = gate
+	s.upstreamFetchGateMu.Unlock()
+	return func() {
+		s.upstreamFetchGateMu.Lock()
+		s.upstreamFetchGate = nil
+		s.upstreamFetchGateMu.Unlock()
+		close(gate)
+	}
+}
+
 func (s *TestServer) Close() {
 	s.upstreamServer.Close()
 	s.proxyServer.Close()
+	s.adminServer.Close()
 	s.UpstreamGitRepo.Close()
 }
 
@@ -0,0 +1,90 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// traceFormat is the trace context format of the inbound requests and
+	// the upstream requests (W3C Trace Context).
+	traceFormat = &tracecontext.HTTPFormat{}
+
+	// upstreamHTTPClient is used for the requests to the upstream. It
+	// propagates the trace context.
+	upstreamHTTPClient = &http.Client{
+		Transport: &ochttp.Transport{Propagation: traceFormat},
+	}
+)
+
+// startRequestSpan starts a span for the inbound request. If the request has a
+// trace context, the span becomes a child of it.
+func startRequestSpan(r *http.Request) (*http.Request, *trace.Span) {
+	var ctx context.Context
+	var span *trace.Span
+	if sc, ok := traceFormat.SpanContextFromRequest(r); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(r.Context(), "goblet/http", sc, trace.WithSpanKind(trace.SpanKindServer))
+	} else {
+		ctx, span = trace.StartSpan(r.Context(), "goblet/http", trace.WithSpanKind(trace.SpanKindServer))
+	}
+	span.AddAttributes(
+		trace.StringAttribute(ochttp.MethodAttribute, r.Method),
+		trace.StringAttribute(ochttp.PathAttribute, r.URL.Path),
+	)
+	return r.WithContext(ctx), span
+}
+
+// setSpanError records the error to the span in the context.
+func setSpanError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+	}
+}
+
+// endSpan records the error to the span and ends it.
+func endSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+	}
+	span.End()
+}
+
+// gitTraceArgs returns the git command line options to propagate the trace
+// context of the span in the context to the upstream.
+func gitTraceArgs(ctx context.Context) []string {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	req := &http.Request{Header: http.Header{}}
+	traceFormat.SpanContextToRequest(span.SpanContext(), req)
+	args := []string{}
+	for name, values := range req.Header {
+		for _, v := range values {
+			args = append(args, "-c", "http.extraHeader="+name+": "+v)
+		}
+	}
+	return args
+}
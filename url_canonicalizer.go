@@ -0,0 +1,149 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UpstreamHostRule describes an upstream host that the proxy accepts, and how
+// a request URL is converted to the canonical upstream URL.
+type UpstreamHostRule struct {
+	// Host is a host name of the request URL. A leading "*." matches any
+	// subdomain (e.g. "*.googlesource.com").
+	Host string `json:"host"`
+
+	// UpstreamHost replaces the host if not empty.
+	UpstreamHost string `json:"upstream_host,omitempty"`
+
+	// Scheme is a scheme of the upstream URL. Defaults to "https".
+	Scheme string `json:"scheme,omitempty"`
+
+	// StripPathPrefixes are removed from the beginning of the path. For
+	// example, "/a" removes Gerrit's authenticated path prefix so that
+	// "/a/repo" and "/repo" share the same cache.
+	StripPathPrefixes []string `json:"strip_path_prefixes,omitempty"`
+
+	// PathRewrites are applied to the path in order.
+	PathRewrites []*PathRewriteRule `json:"path_rewrites,omitempty"`
+
+	// KeepGitSuffix keeps the ".git" suffix of the path. By default, the
+	// suffix is removed so that "repo" and "repo.git" share the same cache.
+	KeepGitSuffix bool `json:"keep_git_suffix,omitempty"`
+}
+
+// PathRewriteRule replaces the path matched with Pattern (a regular
+// expression) with Replacement, which can refer to the submatches as $1.
+type PathRewriteRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+type compiledUpstreamHostRule struct {
+	*UpstreamHostRule
+	pathRewrites []*regexp.Regexp
+}
+
+// NewURLCanonicalizer returns a function that can be used as
+// ServerConfig.URLCanonializer. The first rule that matches the request host
+// is used, and the requests for the other hosts are rejected.
+func NewURLCanonicalizer(rules []*UpstreamHostRule) (func(*url.URL) (*url.URL, error), error) {
+	compiled := []*compiledUpstreamHostRule{}
+	for _, rule := range rules {
+		if rule.Host == "" {
+			return nil, fmt.Errorf("upstream host rule without a host")
+		}
+		c := &compiledUpstreamHostRule{UpstreamHostRule: rule}
+		for _, rw := range rule.PathRewrites {
+			re, err := regexp.Compile(rw.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("cannot compile the path rewrite pattern for %s: %v", rule.Host, err)
+			}
+			c.pathRewrites = append(c.pathRewrites, re)
+		}
+		compiled = append(compiled, c)
+	}
+
+	return func(u *url.URL) (*url.URL, error) {
+		host := strings.ToLower(u.Host)
+		for _, rule := range compiled {
+			if rule.matches(host) {
+				return rule.canonicalize(u)
+			}
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported host: %s", u.Host)
+	}, nil
+}
+
+func (c *compiledUpstreamHostRule) matches(host string) bool {
+	pattern := strings.ToLower(c.Host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func (c *compiledUpstreamHostRule) canonicalize(u *url.URL) (*url.URL, error) {
+	ret := url.URL{}
+	ret.Scheme = c.Scheme
+	if ret.Scheme == "" {
+		ret.Scheme = "https"
+	}
+	ret.Host = strings.ToLower(u.Host)
+	if c.UpstreamHost != "" {
+		ret.Host = c.UpstreamHost
+	}
+	ret.Path = trimGitEndpointSuffix(u.Path)
+
+	for _, prefix := range c.StripPathPrefixes {
+		if strings.HasPrefix(ret.Path, prefix+"/") {
+			ret.Path = strings.TrimPrefix(ret.Path, prefix)
+			break
+		}
+	}
+	for i, re := range c.pathRewrites {
+		ret.Path = re.ReplaceAllString(ret.Path, c.PathRewrites[i].Replacement)
+	}
+	if !c.KeepGitSuffix {
+		ret.Path = strings.TrimSuffix(ret.Path, ".git")
+	}
+
+	// The path is used as the cache directory path as well. Do not let
+	// it point outside of the cache root.
+	if strings.Trim(ret.Path, "/") == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "empty repository path: %s", u.Path)
+	}
+	for _, segment := range strings.Split(ret.Path, "/") {
+		if segment == ".." {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid repository path: %s", u.Path)
+		}
+	}
+	return &ret, nil
+}
+
+func trimGitEndpointSuffix(p string) string {
+	for _, suffix := range []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"} {
+		if strings.HasSuffix(p, suffix) {
+			return strings.TrimSuffix(p, suffix)
+		}
+	}
+	return p
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goblet
+
+import (
+	"net/url"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestURLCanonicalizer(t *testing.T) {
+	canonicalize, err := NewURLCanonicalizer([]*UpstreamHostRule{
+		{
+			Host:              "*.googlesource.com",
+			StripPathPrefixes: []string{"/a"},
+		},
+		{
+			Host:         "github.com",
+			UpstreamHost: "github.example.com",
+			Scheme:       "http",
+			PathRewrites: []*PathRewriteRule{
+				{Pattern: "^/mirror/(.*)$", Replacement: "/$1"},
+			},
+		},
+		{
+			Host:          "git.example.com",
+			KeepGitSuffix: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   string
+		want string
+		code codes.Code
+	}{
+		{"https://go.googlesource.com/go/info/refs", "https://go.googlesource.com/go", codes.OK},
+		{"https://Go.GoogleSource.com/a/go.git/git-upload-pack", "https://go.googlesource.com/go", codes.OK},
+		{"https://go.googlesource.com/a", "https://go.googlesource.com/a", codes.OK},
+		{"https://github.com/mirror/google/goblet.git", "http://github.example.com/google/goblet", codes.OK},
+		{"https://git.example.com/repo.git/git-receive-pack", "https://git.example.com/repo.git", codes.OK},
+		{"https://git.example.com/a..b", "https://git.example.com/a..b", codes.OK},
+		{"https://example.com/repo", "", codes.InvalidArgument},
+		{"https://go.googlesource.com/info/refs", "", codes.InvalidArgument},
+		{"https://go.googlesource.com/", "", codes.InvalidArgument},
+		{"https://go.googlesource.com/a/", "", codes.InvalidArgument},
+		{"https://go.googlesource.com/.git", "", codes.InvalidArgument},
+		{"https://go.googlesource.com/../repo", "", codes.InvalidArgument},
+		{"https://go.googlesource.com/a/../../repo/info/refs", "", codes.InvalidArgument},
+		{"https://github.com/mirror/..", "", codes.InvalidArgument},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := canonicalize(u)
+		if code := status.Code(err); code != tc.code {
+			t.Errorf("%s: got %v, want %v", tc.in, err, tc.code)
+			continue
+		}
+		if err == nil && got.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}